@@ -79,6 +79,25 @@ func GetAsInt(value interface{}, defaultValue int) (result int) {
 	return
 }
 
+// GetAsBool parses a string/bool to a bool or returns the bool if bool is passed in
+func GetAsBool(value interface{}, defaultValue bool) (result bool) {
+	result = defaultValue
+
+	switch value.(type) {
+	case string:
+		fromString, err := strconv.ParseBool(value.(string))
+		if err == nil {
+			result = fromString
+		} else {
+			log.Warn("Failed to convert value", value, "to a bool")
+		}
+	case bool:
+		result = value.(bool)
+	}
+
+	return
+}
+
 // GetAsMap parses an interface to a map[string]string
 func GetAsMap(value interface{}) (result map[string]string) {
 	result = make(map[string]string)
@@ -0,0 +1,317 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultTLSReloadInterval is how often (seconds) the certificate
+// files are checked for changes
+const DefaultTLSReloadInterval = 60
+
+// GetTLSClientConfig builds a client side TLS configuration from the tls_*
+// keys of a forwarder configuration. It returns nil if TLS is not enabled,
+// which is the case if tls is false, or if it's not set and neither
+// tls_ca_file nor tls_cert_file is.
+//
+// Supported keys:
+//
+//	tls                       enable TLS ("true"/"false")
+//	tls_ca_file               PEM bundle used to verify the server
+//	tls_cert_file             PEM client certificate (needs tls_key_file)
+//	tls_key_file              PEM client private key
+//	tls_server_name           name to verify the server certificate against
+//	tls_insecure_skip_verify  skip server verification, for testing only
+//	tls_min_version           lowest accepted version: 1.0, 1.1, 1.2 or 1.3
+//	tls_cipher_suites         list of cipher suite names, TLS 1.2 and below
+//	tls_reload_interval       seconds between checks of the certificate files
+func GetTLSClientConfig(configMap map[string]interface{}) (*tls.Config, error) {
+	caFile := getAsString(configMap, "tls_ca_file")
+	certFile := getAsString(configMap, "tls_cert_file")
+	keyFile := getAsString(configMap, "tls_key_file")
+
+	enabled := caFile != "" || certFile != ""
+	if v, exists := configMap["tls"]; exists {
+		enabled = GetAsBool(v, false)
+	}
+
+	if !enabled {
+		return nil, nil
+	}
+
+	tlsConfig, err := newTLSConfig(configMap)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.ServerName = getAsString(configMap, "tls_server_name")
+
+	if v, exists := configMap["tls_insecure_skip_verify"]; exists {
+		tlsConfig.InsecureSkipVerify = GetAsBool(v, false)
+	}
+
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		reloader, err := newCertReloader(certFile, keyFile, "", configMap)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.GetClientCertificate = reloader.getClientCertificate
+	}
+
+	return tlsConfig, nil
+}
+
+// GetTLSServerConfig builds a server side TLS configuration from the tls_*
+// keys of a listener configuration. It returns nil if TLS is not enabled,
+// which is the case unless tls_cert_file is set.
+//
+// Supported keys, on top of tls_min_version, tls_cipher_suites and
+// tls_reload_interval:
+//
+//	tls_cert_file    PEM server certificate
+//	tls_key_file     PEM server private key
+//	tls_ca_file      PEM bundle used to verify client certificates
+//	tls_client_auth  none, request, verify_if_given or require
+//
+// The certificate, key and CA files are reloaded when they change.
+func GetTLSServerConfig(configMap map[string]interface{}) (*tls.Config, error) {
+	certFile := getAsString(configMap, "tls_cert_file")
+	keyFile := getAsString(configMap, "tls_key_file")
+	caFile := getAsString(configMap, "tls_ca_file")
+
+	if certFile == "" {
+		if keyFile != "" || caFile != "" {
+			return nil, fmt.Errorf("tls_cert_file is required to enable TLS")
+		}
+		return nil, nil
+	}
+
+	tlsConfig, err := newTLSConfig(configMap)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig.ClientAuth = tls.NoClientCert
+	if caFile != "" {
+		// a CA to verify clients against implies they must present a certificate
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	if v, exists := configMap["tls_client_auth"]; exists {
+		switch strings.ToLower(fmt.Sprint(v)) {
+		case "none":
+			tlsConfig.ClientAuth = tls.NoClientCert
+		case "request":
+			tlsConfig.ClientAuth = tls.RequestClientCert
+		case "verify_if_given":
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		case "require":
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		default:
+			return nil, fmt.Errorf("invalid tls_client_auth %v", v)
+		}
+	}
+
+	if caFile == "" && (tlsConfig.ClientAuth == tls.VerifyClientCertIfGiven ||
+		tlsConfig.ClientAuth == tls.RequireAndVerifyClientCert) {
+		return nil, fmt.Errorf("tls_ca_file is required to verify client certificates")
+	}
+
+	reloader, err := newCertReloader(certFile, keyFile, caFile, configMap)
+	if err != nil {
+		return nil, err
+	}
+
+	// every handshake gets the latest certificate and client CAs
+	tlsConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		cert, pool := reloader.current()
+		cfg := tlsConfig.Clone()
+		cfg.GetConfigForClient = nil
+		cfg.Certificates = []tls.Certificate{*cert}
+		cfg.ClientCAs = pool
+		return cfg, nil
+	}
+
+	return tlsConfig, nil
+}
+
+// newTLSConfig handles the keys shared by clients and servers
+func newTLSConfig(configMap map[string]interface{}) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if v, exists := configMap["tls_min_version"]; exists {
+		switch fmt.Sprint(v) {
+		case "1.0":
+			tlsConfig.MinVersion = tls.VersionTLS10
+		case "1.1":
+			tlsConfig.MinVersion = tls.VersionTLS11
+		case "1.2":
+			tlsConfig.MinVersion = tls.VersionTLS12
+		case "1.3":
+			tlsConfig.MinVersion = tls.VersionTLS13
+		default:
+			return nil, fmt.Errorf("invalid tls_min_version %v, expected 1.0, 1.1, 1.2 or 1.3", v)
+		}
+	}
+
+	if v, exists := configMap["tls_cipher_suites"]; exists {
+		known := make(map[string]uint16)
+		for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+			known[suite.Name] = suite.ID
+		}
+
+		for _, name := range GetAsSlice(v) {
+			id, ok := known[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown cipher suite %s", name)
+			}
+			tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// certReloader serves a key pair and CA pool, reloading them
+// at most once per interval if any of the files changed
+type certReloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+	interval time.Duration
+
+	lock    sync.Mutex
+	cert    *tls.Certificate
+	pool    *x509.CertPool
+	modTime time.Time
+	checked time.Time
+}
+
+func newCertReloader(certFile, keyFile, caFile string, configMap map[string]interface{}) (*certReloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("tls_cert_file and tls_key_file must be set together")
+	}
+
+	r := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+		interval: DefaultTLSReloadInterval * time.Second,
+	}
+
+	if v, exists := configMap["tls_reload_interval"]; exists {
+		r.interval = time.Duration(GetAsInt(v, DefaultTLSReloadInterval)) * time.Second
+	}
+
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// load reads the files, it's called with the lock held or before the reloader is shared
+func (r *certReloader) load() error {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("cannot load TLS key pair: %s", err)
+	}
+
+	var pool *x509.CertPool
+	if r.caFile != "" {
+		if pool, err = loadCertPool(r.caFile); err != nil {
+			return err
+		}
+	}
+
+	r.cert = &cert
+	r.pool = pool
+	r.modTime = modTime
+	r.checked = time.Now()
+	return nil
+}
+
+func (r *certReloader) latestModTime() (latest time.Time, err error) {
+	for _, file := range []string{r.certFile, r.keyFile, r.caFile} {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return latest, fmt.Errorf("cannot stat %s: %s", file, err)
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// current returns the key pair and CA pool, reloaded if the files changed.
+// A failed reload keeps serving the previous ones.
+func (r *certReloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if time.Since(r.checked) >= r.interval {
+		r.checked = time.Now()
+		if modTime, err := r.latestModTime(); err != nil {
+			log.Warn("Not reloading TLS certificate: ", err)
+		} else if !modTime.Equal(r.modTime) {
+			if err := r.load(); err != nil {
+				log.Warn("Failed to reload TLS certificate, keeping the previous one: ", err)
+			} else {
+				log.Info("Reloaded TLS certificate ", r.certFile)
+			}
+		}
+	}
+
+	return r.cert, r.pool
+}
+
+func (r *certReloader) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	cert, _ := r.current()
+	return cert, nil
+}
+
+// loadCertPool reads a PEM bundle into a certificate pool
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read CA file: %s", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA file %s", caFile)
+	}
+	return pool, nil
+}
+
+// getAsString returns the value of key as a string or "" if it's not set
+func getAsString(configMap map[string]interface{}, key string) string {
+	if v, exists := configMap[key]; exists {
+		if str, ok := v.(string); ok {
+			return str
+		}
+		log.Warn("Expected a string for ", key, " but got ", v)
+	}
+	return ""
+}
@@ -0,0 +1,97 @@
+package forwarder
+
+import (
+	"sync"
+	"time"
+)
+
+// batcher collects the messages of a forwarder and hands them to send in
+// batches, once maxCount or maxBytes is reached or every timeout. A batch
+// is sent while the next one is filled, add blocks while send is behind
+// so backpressure reaches the listeners.
+type batcher struct {
+	// a limit of 0 is no limit
+	maxCount int
+	maxBytes int
+	timeout  time.Duration
+
+	// bytes each message adds to a batch besides its own, e.g. a delimiter
+	overhead int
+
+	send func(batch [][]byte)
+
+	lock  sync.Mutex
+	batch [][]byte
+	count int
+	bytes int
+	queue chan [][]byte
+}
+
+// newBatcher returns a batcher, start it before adding messages
+func newBatcher(maxCount, maxBytes int, timeout time.Duration, send func(batch [][]byte)) *batcher {
+	return &batcher{
+		maxCount: maxCount,
+		maxBytes: maxBytes,
+		timeout:  timeout,
+		send:     send,
+		// one batch queued while another is being sent
+		queue: make(chan [][]byte, 1),
+	}
+}
+
+// start sends the batches and flushes the pending one every timeout
+func (b *batcher) start() {
+	go func() {
+		for batch := range b.queue {
+			b.send(batch)
+		}
+	}()
+
+	go func() {
+		ticker := time.NewTicker(b.timeout)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			b.flush()
+		}
+	}()
+}
+
+// add copies msg into the pending batch, in which it counts as count
+// towards maxCount. The message is released once emitFunc returns and
+// its payload goes back to the pool, the batch can't keep it.
+func (b *batcher) add(msg []byte, count int) {
+	msg = append([]byte(nil), msg...)
+	size := len(msg) + b.overhead
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.maxBytes > 0 && b.bytes > 0 && b.bytes+size > b.maxBytes {
+		b.flushLocked()
+	}
+	b.batch = append(b.batch, msg)
+	b.count += count
+	b.bytes += size
+	if (b.maxCount > 0 && b.count >= b.maxCount) || (b.maxBytes > 0 && b.bytes >= b.maxBytes) {
+		b.flushLocked()
+	}
+}
+
+// flush hands the pending batch to send
+func (b *batcher) flush() {
+	b.lock.Lock()
+	b.flushLocked()
+	b.lock.Unlock()
+}
+
+// flushLocked queues the pending batch, lock must be held
+func (b *batcher) flushLocked() {
+	if len(b.batch) == 0 {
+		return
+	}
+	b.queue <- b.batch
+	b.batch = nil
+	b.count = 0
+	b.bytes = 0
+}
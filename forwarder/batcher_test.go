@@ -0,0 +1,118 @@
+package forwarder
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// queued returns the batches flushed so far, the batcher isn't started
+func queued(b *batcher) [][][]byte {
+	var batches [][][]byte
+	for len(b.queue) > 0 {
+		batches = append(batches, <-b.queue)
+	}
+	return batches
+}
+
+func TestBatcherFlushes(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxCount int
+		maxBytes int
+		overhead int
+		msgs     []string
+		counts   []int
+		expected [][][]byte
+	}{
+		{
+			name:     "count",
+			maxCount: 2,
+			msgs:     []string{"a", "b", "c"},
+			counts:   []int{1, 1, 1},
+			expected: [][][]byte{{[]byte("a"), []byte("b")}},
+		},
+		{
+			name:     "weighted count",
+			maxCount: 3,
+			msgs:     []string{"a", "b", "c"},
+			counts:   []int{2, 2, 1},
+			expected: [][][]byte{{[]byte("a"), []byte("b")}},
+		},
+		{
+			name:     "bytes reached",
+			maxBytes: 4,
+			msgs:     []string{"ab", "cd", "e"},
+			counts:   []int{1, 1, 1},
+			expected: [][][]byte{{[]byte("ab"), []byte("cd")}},
+		},
+		{
+			name:     "bytes exceeded",
+			maxBytes: 4,
+			msgs:     []string{"abc", "de", "f"},
+			counts:   []int{1, 1, 1},
+			expected: [][][]byte{{[]byte("abc")}},
+		},
+		{
+			name:     "overhead",
+			maxBytes: 6,
+			overhead: 1,
+			msgs:     []string{"ab", "cd", "e"},
+			counts:   []int{1, 1, 1},
+			expected: [][][]byte{{[]byte("ab"), []byte("cd")}},
+		},
+		{
+			name:     "larger than maxBytes",
+			maxBytes: 2,
+			msgs:     []string{"abc", "d"},
+			counts:   []int{1, 1},
+			expected: [][][]byte{{[]byte("abc")}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newBatcher(test.maxCount, test.maxBytes, time.Hour, nil)
+			b.overhead = test.overhead
+			b.queue = make(chan [][]byte, len(test.msgs))
+
+			for i, msg := range test.msgs {
+				b.add([]byte(msg), test.counts[i])
+			}
+			if batches := queued(b); !reflect.DeepEqual(batches, test.expected) {
+				t.Errorf("expected %q, got %q", test.expected, batches)
+			}
+		})
+	}
+}
+
+func TestBatcherOwnsMessages(t *testing.T) {
+	b := newBatcher(0, 0, time.Hour, nil)
+
+	buffer := []byte("first")
+	b.add(buffer, 1)
+	copy(buffer, "reuse")
+	b.flush()
+
+	if batch := <-b.queue; string(batch[0]) != "first" {
+		t.Errorf("expected the batch to keep its copy, got %q", batch[0])
+	}
+}
+
+func TestBatcherSendsEveryTimeout(t *testing.T) {
+	sent := make(chan [][]byte, 1)
+	b := newBatcher(100, 0, 10*time.Millisecond, func(batch [][]byte) {
+		sent <- batch
+	})
+	b.start()
+
+	b.add([]byte("a"), 1)
+	select {
+	case batch := <-sent:
+		if len(batch) != 1 || string(batch[0]) != "a" {
+			t.Errorf("expected the pending message, got %q", batch)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the batch to be sent after the timeout")
+	}
+}
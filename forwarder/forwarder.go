@@ -1,10 +1,18 @@
 package forwarder
 
 import (
+	"fmt"
+	"math"
+	"net"
 	"sync/atomic"
+	"time"
 
 	l "github.com/Sirupsen/logrus"
 	"github.com/tsheasha/relayd/config"
+	"github.com/tsheasha/relayd/histogram"
+	"github.com/tsheasha/relayd/message"
+	"github.com/tsheasha/relayd/rate"
+	"github.com/tsheasha/relayd/ratelimit"
 )
 
 // Some sane values to default things to
@@ -13,6 +21,12 @@ const (
 	DefaultKeepAliveInterval = 30
 )
 
+// operations errors are counted by, see countError
+const (
+	opDial  = "dial"
+	opWrite = "write"
+)
+
 var defaultLog = l.WithFields(l.Fields{"app": "relayd", "pkg": "forwarder"})
 
 var forwarderConstructs map[string]func(int, *l.Entry) Forwarder
@@ -38,9 +52,11 @@ func New(name string) Forwarder {
 }
 
 // InternalMetrics holds the key:value pairs for counters/gauges
+// and the latency histograms
 type InternalMetrics struct {
-	Counters map[string]float64
-	Gauges   map[string]float64
+	Counters   map[string]float64
+	Gauges     map[string]float64
+	Histograms map[string]histogram.Snapshot `json:",omitempty"`
 }
 
 // NewInternalMetrics initializes the internal components of InternalMetrics
@@ -65,19 +81,22 @@ type Forwarder interface {
 	Name() string
 	String() string
 
-	ListenerChannels() map[string]chan []byte
-	SetListenerChannels(map[string]chan []byte)
+	ListenerChannels() map[string]chan *message.Message
+	SetListenerChannels(map[string]chan *message.Message)
 
 	MaxBufferSize() int
 	SetMaxBufferSize(int)
 
 	KeepAliveInterval() int
 	SetKeepAliveInterval(int)
+
+	// nil unless rate_limit is set
+	RateLimiter() *ratelimit.Limiter
 }
 
 // BaseForwarder is class to handle the boiler plate parts of the forwarders
 type BaseForwarder struct {
-	listenerChannels map[string]chan []byte
+	listenerChannels map[string]chan *message.Message
 	name             string
 	log              *l.Entry
 
@@ -86,9 +105,52 @@ type BaseForwarder struct {
 	// for keepalive
 	keepAliveInterval int
 
+	// only messages matching the routes are relayed
+	routes routes
+
+	// only a sample of the messages is relayed when set
+	sampler *sampler
+
+	// the messages relayed go through the processors first
+	processors processors
+
+	// set when the configuration is unusable, every message is then
+	// dropped rather than left to block the listeners
+	confErr error
+
+	rateLimiter *ratelimit.Limiter
+
+	// deepest each listener channel was seen, by listener name
+	queueHighWater map[string]*uint64
+
+	// set by the forwarders batching messages, which count the ones
+	// emitFunc queued as sent once their batch is, and observe sendTime
+	// per batch
+	batched bool
+
+	// totalEmissions counts the messages passed to emitFunc,
+	// msgsSent and msgsDropped tell how it went
 	totalEmissions uint64
 	msgsSent       uint64
 	msgsDropped    uint64
+	msgsUnrouted   uint64
+	msgsFiltered   uint64
+	msgsSampledOut uint64
+
+	// payload bytes taken off the channels and sent
+	bytesReceived uint64
+	bytesSent     uint64
+	received      rate.Meter
+	sent          rate.Meter
+
+	errorsDial    uint64
+	errorsWrite   uint64
+	errorsTimeout uint64
+
+	// time from receiving a message to passing it to emitFunc,
+	// and the time emitFunc takes, or a batch takes to be written
+	queueTime histogram.Histogram
+	sendTime  histogram.Histogram
 }
 
 // SetMaxBufferSize : set the buffer size
@@ -97,25 +159,27 @@ func (base *BaseForwarder) SetMaxBufferSize(size int) {
 }
 
 // ListenerChannels : the channels to forwarders listens for messages on
-func (base BaseForwarder) ListenerChannels() map[string]chan []byte {
+func (base *BaseForwarder) ListenerChannels() map[string]chan *message.Message {
 	return base.listenerChannels
 }
 
 // SetListenerChannels : the channels to forwarder listens for messages on
-func (base *BaseForwarder) SetListenerChannels(c map[string]chan []byte) {
-	base.listenerChannels = make(map[string]chan []byte)
+func (base *BaseForwarder) SetListenerChannels(c map[string]chan *message.Message) {
+	base.listenerChannels = make(map[string]chan *message.Message)
+	base.queueHighWater = make(map[string]*uint64)
 	for name, channel := range c {
 		base.listenerChannels[name] = channel
+		base.queueHighWater[name] = new(uint64)
 	}
 }
 
 // Name : the name of the forwarder
-func (base BaseForwarder) Name() string {
+func (base *BaseForwarder) Name() string {
 	return base.name
 }
 
 // MaxBufferSize : the maximum number of messages to be in the circular buffer
-func (base BaseForwarder) MaxBufferSize() int {
+func (base *BaseForwarder) MaxBufferSize() int {
 	return base.maxBufferSize
 }
 
@@ -126,33 +190,83 @@ func (base *BaseForwarder) SetKeepAliveInterval(value int) {
 
 // InitListeners - initiate channels for listeners
 func (base *BaseForwarder) InitListeners(globalConfig config.Config) {
-	lietenerChannels := make(map[string]chan []byte)
+	lietenerChannels := make(map[string]chan *message.Message)
 	for name := range globalConfig.Listeners {
-		lietenerChannels[name] = make(chan []byte, base.MaxBufferSize())
+		lietenerChannels[name] = make(chan *message.Message, base.MaxBufferSize())
 	}
 	base.SetListenerChannels(lietenerChannels)
 }
 
 // KeepAliveInterval - return keep alive interval
-func (base BaseForwarder) KeepAliveInterval() int {
+func (base *BaseForwarder) KeepAliveInterval() int {
 	return base.keepAliveInterval
 }
 
+// RateLimiter : the limiter of the messages relayed, if any
+func (base *BaseForwarder) RateLimiter() *ratelimit.Limiter {
+	return base.rateLimiter
+}
+
 // String returns the forwarder name in a printable format.
-func (base BaseForwarder) String() string {
+func (base *BaseForwarder) String() string {
 	return base.name + "Forwarder"
 }
 
 // InternalMetrics : Returns the internal metrics that are being collected by this forwarder
-func (base BaseForwarder) InternalMetrics() InternalMetrics {
+func (base *BaseForwarder) InternalMetrics() InternalMetrics {
 	counters := map[string]float64{
-		"totalEmissions": float64(base.totalEmissions),
-		"msgsDropped":    float64(base.msgsDropped),
-		"msgsSent":       float64(base.msgsSent),
+		"totalEmissions": float64(atomic.LoadUint64(&base.totalEmissions)),
+		"msgsDropped":    float64(atomic.LoadUint64(&base.msgsDropped)),
+		"msgsSent":       float64(atomic.LoadUint64(&base.msgsSent)),
+		"msgsUnrouted":   float64(atomic.LoadUint64(&base.msgsUnrouted)),
+		"msgsFiltered":   float64(atomic.LoadUint64(&base.msgsFiltered)),
+		"msgsSampledOut": float64(atomic.LoadUint64(&base.msgsSampledOut)),
+		"bytesReceived":  float64(atomic.LoadUint64(&base.bytesReceived)),
+		"bytesSent":      float64(atomic.LoadUint64(&base.bytesSent)),
+		"errorsDial":     float64(atomic.LoadUint64(&base.errorsDial)),
+		"errorsWrite":    float64(atomic.LoadUint64(&base.errorsWrite)),
+		"errorsTimeout":  float64(atomic.LoadUint64(&base.errorsTimeout)),
+	}
+	base.sampler.addCounters(counters)
+	base.processors.addCounters(counters)
+
+	gauges := make(map[string]float64)
+	if base.rateLimiter != nil {
+		base.rateLimiter.AddMetrics(counters, gauges)
+	}
+
+	// per second rates, suffixed with their window
+	msgsRates, bytesRates := base.received.Rates()
+	for window := range rate.Windows {
+		gauges["msgsReceivedRate"+window] = msgsRates[window]
+		gauges["bytesReceivedRate"+window] = bytesRates[window]
+	}
+	msgsRates, bytesRates = base.sent.Rates()
+	for window := range rate.Windows {
+		gauges["msgsSentRate"+window] = msgsRates[window]
+		gauges["bytesSentRate"+window] = bytesRates[window]
+	}
+
+	// queue gauges per listener channel, suffixed with the listener name
+	for name, c := range base.listenerChannels {
+		length, capacity := len(c), cap(c)
+		gauges["queueLength"+name] = float64(length)
+		gauges["queueCapacity"+name] = float64(capacity)
+		gauges["queueHighWater"+name] = float64(atomic.LoadUint64(base.queueHighWater[name]))
+		if capacity > 0 {
+			gauges["queueUtilization"+name] = float64(length) / float64(capacity)
+		}
+	}
+
+	histograms := map[string]histogram.Snapshot{
+		"queueTime": base.queueTime.Snapshot(),
+		"sendTime":  base.sendTime.Snapshot(),
 	}
 
 	return InternalMetrics{
-		Counters: counters,
+		Counters:   counters,
+		Gauges:     gauges,
+		Histograms: histograms,
 	}
 }
 
@@ -167,24 +281,126 @@ func (base *BaseForwarder) configureCommonParams(configMap map[string]interface{
 		keepAliveInterval := config.GetAsInt(asInterface, DefaultKeepAliveInterval)
 		base.SetKeepAliveInterval(keepAliveInterval)
 	}
+
+	if asInterface, exists := configMap["routes"]; exists {
+		base.routes = newRoutes(asInterface)
+	}
+
+	if asInterface, exists := configMap["sample_rate"]; exists {
+		key := ""
+		if k, exists := configMap["sample_key"]; exists {
+			key = fmt.Sprint(k)
+		}
+		// a rate that isn't a number is NaN, which is rejected
+		sampler, err := newSampler(config.GetAsFloat(asInterface, math.NaN()), key)
+		if err != nil {
+			base.log.Error("Invalid sample_rate, every message will be dropped: ", err)
+			base.confErr = err
+		}
+		base.sampler = sampler
+	}
+
+	if asInterface, exists := configMap["processors"]; exists {
+		chain, err := newProcessors(asInterface)
+		if err != nil {
+			base.log.Error("Invalid processors, every message will be dropped: ", err)
+			base.confErr = err
+		}
+		base.processors = chain
+	}
+
+	if asInterface, exists := configMap["rate_limit"]; exists {
+		limiter, err := ratelimit.Parse(asInterface)
+		if err != nil {
+			base.log.Error("Invalid rate_limit, ignoring it: ", err)
+		}
+		base.rateLimiter = limiter
+		if base.rateLimiter != nil && base.rateLimiter.DivertTo() == base.name {
+			base.log.Error("A forwarder can't divert to itself, ignoring rate_limit")
+			base.rateLimiter = nil
+		}
+	}
 }
 
+// run starts relaying the messages of every listener with emitFunc,
+// which must not keep the payload it's passed once it returns
 func (base *BaseForwarder) run(emitFunc func([]byte) bool) {
 	for k := range base.ListenerChannels() {
-		go base.listenForMsgs(emitFunc, base.ListenerChannels()[k])
+		go base.listenForMsgs(emitFunc, base.ListenerChannels()[k], base.queueHighWater[k])
 	}
 }
 
 func (base *BaseForwarder) listenForMsgs(
 	emitFunc func([]byte) bool,
-	c <-chan []byte) {
+	c <-chan *message.Message,
+	highWater *uint64) {
 
 	for incomingMsg := range c {
-		base.log.Debug(base.Name(), " msg: ", string(incomingMsg))
-		result := emitFunc(incomingMsg)
+		// the message just taken counted towards the depth too
+		depth := len(c) + 1
+		if depth > cap(c) {
+			depth = cap(c)
+		}
+		storeMax(highWater, uint64(depth))
+
+		size := len(incomingMsg.Payload)
+		atomic.AddUint64(&base.bytesReceived, uint64(size))
+		base.received.Mark(size)
+
+		if base.confErr != nil {
+			atomic.AddUint64(&base.msgsDropped, 1)
+			incomingMsg.Fail()
+			incomingMsg.Release()
+			continue
+		}
+
+		if !base.routes.match(incomingMsg) {
+			atomic.AddUint64(&base.msgsUnrouted, 1)
+			incomingMsg.Release()
+			continue
+		}
+
+		if !base.sampler.keep(incomingMsg) {
+			atomic.AddUint64(&base.msgsSampledOut, 1)
+			incomingMsg.Release()
+			continue
+		}
+
+		payload, keep := base.processors.run(incomingMsg)
+		if !keep {
+			atomic.AddUint64(&base.msgsFiltered, 1)
+			incomingMsg.Release()
+			continue
+		}
+		size = len(payload)
+
+		if base.rateLimiter != nil && !base.rateLimiter.Take(incomingMsg, size) {
+			if base.rateLimiter.Action() != ratelimit.Divert || !base.rateLimiter.Divert(incomingMsg) {
+				incomingMsg.Fail()
+				incomingMsg.Release()
+			}
+			continue
+		}
+
+		base.log.Debug(base.Name(), " msg: ", string(payload))
+		start := time.Now()
+		if !incomingMsg.Received.IsZero() {
+			base.queueTime.Observe(start.Sub(incomingMsg.Received))
+		}
+		atomic.AddUint64(&base.totalEmissions, 1)
+		result := emitFunc(payload)
+		if !base.batched {
+			base.sendTime.Observe(time.Since(start))
+		}
+		if !result {
+			incomingMsg.Fail()
+		}
+		incomingMsg.Release()
 
 		if result {
-			atomic.AddUint64(&base.msgsSent, 1)
+			if !base.batched {
+				base.countSent(size)
+			}
 			base.log.Debug("Relay Successful")
 		} else {
 			base.log.Debug("Relay Failed")
@@ -192,3 +408,32 @@ func (base *BaseForwarder) listenForMsgs(
 		}
 	}
 }
+
+// countSent counts a message of size bytes as sent
+func (base *BaseForwarder) countSent(size int) {
+	atomic.AddUint64(&base.msgsSent, 1)
+	atomic.AddUint64(&base.bytesSent, uint64(size))
+	base.sent.Mark(size)
+}
+
+// countError counts err by cause: timeouts whatever the operation,
+// otherwise failing to connect (opDial) or to send (opWrite)
+func (base *BaseForwarder) countError(op string, err error) {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		atomic.AddUint64(&base.errorsTimeout, 1)
+	} else if op == opDial {
+		atomic.AddUint64(&base.errorsDial, 1)
+	} else {
+		atomic.AddUint64(&base.errorsWrite, 1)
+	}
+}
+
+// storeMax sets *addr to v if v is larger
+func storeMax(addr *uint64, v uint64) {
+	for {
+		current := atomic.LoadUint64(addr)
+		if v <= current || atomic.CompareAndSwapUint64(addr, current, v) {
+			return
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package forwarder
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+)
+
+// Framings supported by the stream forwarders, set with the "framing" key
+const (
+	// framingRaw writes messages as they are
+	framingRaw = "raw"
+
+	// framingNewline terminates every message with a newline
+	framingNewline = "newline"
+
+	// framingLength prefixes every message with its length
+	// as a 4 bytes big endian integer
+	framingLength = "length"
+)
+
+var newline = []byte("\n")
+
+// configureFraming returns the framing set in configMap, raw by default
+func (base *BaseForwarder) configureFraming(configMap map[string]interface{}) string {
+	framing, exists := configMap["framing"]
+	if !exists {
+		return framingRaw
+	}
+
+	switch framing {
+	case framingRaw, framingNewline, framingLength:
+		return framing.(string)
+	}
+
+	base.log.Error("Unknown framing ", framing, ", falling back to ", framingRaw)
+	return framingRaw
+}
+
+// writeFrame writes m to w framed according to framing, in a single
+// writev where the connection supports it
+func writeFrame(w io.Writer, framing string, m []byte) error {
+	var buffers net.Buffers
+	switch framing {
+	case framingNewline:
+		buffers = net.Buffers{m, newline}
+	case framingLength:
+		prefix := make([]byte, 4)
+		binary.BigEndian.PutUint32(prefix, uint32(len(m)))
+		buffers = net.Buffers{prefix, m}
+	default:
+		_, err := w.Write(m)
+		return err
+	}
+
+	_, err := buffers.WriteTo(w)
+	return err
+}
@@ -0,0 +1,233 @@
+package forwarder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+	"github.com/tsheasha/relayd/config"
+	"github.com/tsheasha/relayd/graphite"
+)
+
+// Defaults of the Graphite forwarder
+const (
+	DefaultGraphiteBatchSize    = 500
+	DefaultGraphiteBatchTimeout = 1000
+	DefaultGraphiteDialTimeout  = 5000
+)
+
+// protocols, set with the "protocol" key
+const (
+	graphitePlaintext = "plaintext"
+	graphitePickle    = "pickle"
+)
+
+func init() {
+	RegisterForwarder("Graphite", newGraphite)
+}
+
+// Graphite forwarder batches plaintext protocol lines and sends them
+// to carbon as plaintext or pickle. Messages may hold several lines,
+// the ones that aren't valid datapoints are dropped.
+type Graphite struct {
+	BaseForwarder
+	server       string
+	port         string
+	protocol     string
+	batchSize    int
+	batchTimeout time.Duration
+
+	// conn is (re)dialed by the first batch sent after a failure,
+	// only the batcher's sender uses it
+	conn    net.Conn
+	batcher *batcher
+
+	msgsInvalid   uint64
+	batchesSent   uint64
+	batchesFailed uint64
+	msgsFailed    uint64
+}
+
+// newGraphite returns a new Graphite forwarder
+func newGraphite(
+	initialBufferSize int,
+	log *l.Entry) Forwarder {
+
+	g := new(Graphite)
+	g.name = "Graphite"
+
+	g.maxBufferSize = initialBufferSize
+	g.log = log
+
+	g.protocol = graphitePlaintext
+	g.batchSize = DefaultGraphiteBatchSize
+	g.batchTimeout = DefaultGraphiteBatchTimeout * time.Millisecond
+	return g
+}
+
+// Configure the Graphite forwarder
+func (g *Graphite) Configure(configMap map[string]interface{}) {
+	if server, exists := configMap["server"]; exists {
+		g.server = fmt.Sprint(server)
+	} else {
+		g.log.Error("There was no server specified, there won't be any emissions")
+		g.confErr = errors.New("no server specified")
+	}
+
+	if protocol, exists := configMap["protocol"]; exists {
+		switch name := fmt.Sprint(protocol); name {
+		case graphitePlaintext, graphitePickle:
+			g.protocol = name
+		default:
+			g.log.Error("Unknown protocol ", protocol, ", falling back to ", g.protocol)
+		}
+	}
+
+	if port, exists := configMap["port"]; exists {
+		g.port = fmt.Sprint(port)
+	} else if g.protocol == graphitePickle {
+		g.port = "2004"
+	} else {
+		g.port = "2003"
+	}
+
+	if v, exists := configMap["batch_n"]; exists {
+		g.batchSize = config.GetAsInt(v, DefaultGraphiteBatchSize)
+	}
+
+	if v, exists := configMap["batch_timeout"]; exists {
+		if ms := config.GetAsInt(v, DefaultGraphiteBatchTimeout); ms > 0 {
+			g.batchTimeout = time.Duration(ms) * time.Millisecond
+		} else {
+			g.log.Error("Invalid batch_timeout ", v, ", falling back to ", DefaultGraphiteBatchTimeout)
+		}
+	}
+
+	g.configureCommonParams(configMap)
+}
+
+// Run runs the forwarder main loop, without server every message is dropped
+func (g *Graphite) Run() {
+	g.batcher = newBatcher(g.batchSize, 0, g.batchTimeout, g.sendBatches)
+	g.batcher.start()
+	g.batched = true
+	g.run(g.emitMsg)
+}
+
+// InternalMetrics : the base counters plus batch counters
+func (g *Graphite) InternalMetrics() InternalMetrics {
+	m := g.BaseForwarder.InternalMetrics()
+	m.Counters["msgsInvalid"] = float64(atomic.LoadUint64(&g.msgsInvalid))
+	m.Counters["batchesSent"] = float64(atomic.LoadUint64(&g.batchesSent))
+	m.Counters["batchesFailed"] = float64(atomic.LoadUint64(&g.batchesFailed))
+	m.Counters["msgsFailed"] = float64(atomic.LoadUint64(&g.msgsFailed))
+	return m
+}
+
+// emitMsg adds the datapoints of m to the current batch, as plaintext
+// lines with their timestamp set. The message is counted as sent once
+// its batch is, or in msgsFailed if the batch is lost.
+func (g *Graphite) emitMsg(m []byte) bool {
+	var lines []byte
+	datapoints := 0
+	for _, line := range bytes.Split(m, newline) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		metric, err := graphite.ParseLine(line)
+		if err != nil {
+			atomic.AddUint64(&g.msgsInvalid, 1)
+			g.log.Debug("Dropping invalid line ", string(line), ": ", err)
+			continue
+		}
+		if metric.Timestamp == -1 {
+			metric.Timestamp = time.Now().Unix()
+		}
+		lines = append(metric.AppendLine(lines), '\n')
+		datapoints++
+	}
+
+	if datapoints == 0 {
+		return false
+	}
+
+	// batch_n counts datapoints rather than messages
+	g.batcher.add(lines, datapoints)
+	return true
+}
+
+func (g *Graphite) sendBatches(batch [][]byte) {
+	payload := g.encode(batch)
+	start := time.Now()
+	delivered := g.send(payload)
+	g.sendTime.Observe(time.Since(start))
+
+	if delivered {
+		atomic.AddUint64(&g.batchesSent, 1)
+		// the bytes of the lines the message was turned into
+		for _, lines := range batch {
+			g.countSent(len(lines))
+		}
+	} else {
+		g.log.Error("Dropping batch of ", len(batch), " messages")
+		atomic.AddUint64(&g.batchesFailed, 1)
+		atomic.AddUint64(&g.msgsFailed, uint64(len(batch)))
+	}
+}
+
+// encode turns a batch of plaintext lines into the configured protocol
+func (g *Graphite) encode(batch [][]byte) []byte {
+	if g.protocol == graphitePickle {
+		var metrics []graphite.Metric
+		for _, lines := range batch {
+			for _, line := range bytes.Split(bytes.TrimSuffix(lines, newline), newline) {
+				// emitMsg wrote them, they're valid
+				metric, _ := graphite.ParseLine(line)
+				metrics = append(metrics, metric)
+			}
+		}
+
+		// reserve the length prefix and fill it in once the size is known
+		payload := graphite.AppendPickle(make([]byte, 4), metrics)
+		binary.BigEndian.PutUint32(payload, uint32(len(payload)-4))
+		return payload
+	}
+
+	return bytes.Join(batch, nil)
+}
+
+// send writes payload, reconnecting once if the connection was lost
+func (g *Graphite) send(payload []byte) bool {
+	for attempt := 0; attempt < 2; attempt++ {
+		if g.conn == nil {
+			conn, err := net.DialTimeout("tcp", net.JoinHostPort(g.server, g.port), DefaultGraphiteDialTimeout*time.Millisecond)
+			if err != nil {
+				g.countError(opDial, err)
+				g.log.Error("Could not connect to carbon: ", err)
+				return false
+			}
+			if tcp, ok := conn.(*net.TCPConn); ok {
+				tcp.SetKeepAlive(true)
+				tcp.SetKeepAlivePeriod(time.Duration(g.KeepAliveInterval()) * time.Second)
+			}
+			g.conn = conn
+		}
+
+		_, err := g.conn.Write(payload)
+		if err == nil {
+			return true
+		}
+
+		g.countError(opWrite, err)
+		g.log.Warn("Failed to send batch to carbon: ", err)
+		g.conn.Close()
+		g.conn = nil
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+package forwarder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+	"github.com/tsheasha/relayd/graphite"
+)
+
+func newTestGraphite(configMap map[string]interface{}) *Graphite {
+	logger := l.New()
+	logger.Out = ioutil.Discard
+	g := newGraphite(100, l.NewEntry(logger)).(*Graphite)
+	g.Configure(configMap)
+	return g
+}
+
+var graphiteBatch = []graphite.Metric{
+	{Path: "servers.web1.load", Value: 1.5, Timestamp: 1500000000},
+	{Path: "servers.web1.cpu", Value: -0.25, Timestamp: 1500000001},
+	{Path: "servers.web2.load", Value: 3, Timestamp: 1500000002},
+}
+
+// graphiteLines is graphiteBatch as batched by emitMsg, the first
+// message holding two datapoints
+func graphiteLines() [][]byte {
+	var lines [][]byte
+	for i, metric := range graphiteBatch {
+		line := append(metric.AppendLine(nil), '\n')
+		if i == 1 {
+			lines[0] = append(lines[0], line...)
+		} else {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func TestGraphiteEncodePickle(t *testing.T) {
+	g := newTestGraphite(map[string]interface{}{"server": "localhost", "protocol": "pickle"})
+
+	payload := g.encode(graphiteLines())
+	if n := binary.BigEndian.Uint32(payload); int(n) != len(payload)-4 {
+		t.Fatalf("expected a length prefix of %d, got %d", len(payload)-4, n)
+	}
+
+	metrics, invalid, err := graphite.DecodePickle(payload[4:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if invalid != 0 || !reflect.DeepEqual(metrics, graphiteBatch) {
+		t.Errorf("expected %v, got %v and %d invalid", graphiteBatch, metrics, invalid)
+	}
+}
+
+func TestGraphiteEncodePlaintext(t *testing.T) {
+	g := newTestGraphite(map[string]interface{}{"server": "localhost"})
+
+	lines := bytes.Split(bytes.TrimSuffix(g.encode(graphiteLines()), []byte("\n")), []byte("\n"))
+	if len(lines) != len(graphiteBatch) {
+		t.Fatalf("expected %d lines, got %q", len(graphiteBatch), lines)
+	}
+	for i, line := range lines {
+		metric, err := graphite.ParseLine(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if metric != graphiteBatch[i] {
+			t.Errorf("expected %v, got %v", graphiteBatch[i], metric)
+		}
+	}
+}
+
+func TestGraphiteEmitMsg(t *testing.T) {
+	g := newTestGraphite(map[string]interface{}{"server": "localhost", "batch_n": 3})
+
+	var sent [][][]byte
+	g.batcher = newBatcher(g.batchSize, 0, time.Hour, func(batch [][]byte) {
+		sent = append(sent, batch)
+	})
+	g.batcher.queue = make(chan [][]byte, 2)
+
+	if g.emitMsg([]byte("invalid\n\n")) {
+		t.Error("expected a message without datapoints to be dropped")
+	}
+	g.emitMsg([]byte("a 1 1500000000\nb 2 -1\n"))
+	if len(g.batcher.queue) != 0 {
+		t.Fatal("expected 2 datapoints to stay batched")
+	}
+	g.emitMsg([]byte("c 3 1500000000"))
+	if len(g.batcher.queue) != 1 {
+		t.Fatal("expected batch_n datapoints to flush the batch")
+	}
+
+	batch := <-g.batcher.queue
+	if len(batch) != 2 || !bytes.HasPrefix(batch[0], []byte("a 1 1500000000\nb 2 ")) || string(batch[1]) != "c 3 1500000000\n" {
+		t.Errorf("unexpected batch %q", batch)
+	}
+	if invalid := atomic.LoadUint64(&g.msgsInvalid); invalid != 1 {
+		t.Errorf("expected 1 invalid line, got %d", invalid)
+	}
+}
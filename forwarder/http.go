@@ -0,0 +1,283 @@
+package forwarder
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+	"github.com/tsheasha/relayd/config"
+)
+
+// Defaults of the HTTP forwarder
+const (
+	DefaultHTTPBatchSize    = 100
+	DefaultHTTPBatchBytes   = 1048576
+	DefaultHTTPBatchTimeout = 1000
+	DefaultHTTPRetries      = 3
+	DefaultHTTPBackoff      = 100
+	DefaultHTTPMaxBackoff   = 10000
+	DefaultHTTPTimeout      = 5000
+)
+
+// Supported request body encodings
+const (
+	httpEncodingLines = "lines" // newline joined messages
+	httpEncodingJSON  = "json"  // JSON array of strings
+)
+
+func init() {
+	RegisterForwarder("HTTP", newHTTP)
+}
+
+// HTTP forwarder batches messages and POSTs them to an endpoint
+type HTTP struct {
+	BaseForwarder
+	url          string
+	headers      map[string]string
+	encoding     string
+	batchSize    int
+	batchBytes   int
+	batchTimeout time.Duration
+	retries      int
+	backoff      time.Duration
+	maxBackoff   time.Duration
+	client       *http.Client
+	batcher      *batcher
+
+	// responses by status class, index 1 through 5
+	responses      [6]uint64
+	requestErrors  uint64
+	requestRetries uint64
+	batchesSent    uint64
+	batchesFailed  uint64
+	msgsFailed     uint64
+}
+
+// newHTTP returns a new HTTP forwarder
+func newHTTP(
+	initialBufferSize int,
+	log *l.Entry) Forwarder {
+
+	h := new(HTTP)
+	h.name = "HTTP"
+
+	h.maxBufferSize = initialBufferSize
+	h.log = log
+
+	h.headers = make(map[string]string)
+	h.encoding = httpEncodingLines
+	h.batchSize = DefaultHTTPBatchSize
+	h.batchBytes = DefaultHTTPBatchBytes
+	h.batchTimeout = DefaultHTTPBatchTimeout * time.Millisecond
+	h.retries = DefaultHTTPRetries
+	h.backoff = DefaultHTTPBackoff * time.Millisecond
+	h.maxBackoff = DefaultHTTPMaxBackoff * time.Millisecond
+	h.client = &http.Client{Timeout: DefaultHTTPTimeout * time.Millisecond}
+	return h
+}
+
+// Configure the HTTP forwarder
+func (h *HTTP) Configure(configMap map[string]interface{}) {
+	if endpoint, exists := configMap["url"]; exists {
+		if endpoint, ok := endpoint.(string); ok && endpoint != "" {
+			h.url = endpoint
+		} else {
+			h.log.Error("Invalid url ", endpoint, ", there won't be any emissions")
+			h.confErr = fmt.Errorf("invalid url %v", endpoint)
+		}
+	} else {
+		h.log.Error("There was no url specified, there won't be any emissions")
+		h.confErr = errors.New("no url specified")
+	}
+
+	if headers, exists := configMap["headers"]; exists {
+		h.headers = config.GetAsMap(headers)
+	}
+
+	if encoding, exists := configMap["encoding"]; exists {
+		switch encoding {
+		case httpEncodingLines, httpEncodingJSON:
+			h.encoding = encoding.(string)
+		default:
+			h.log.Error("Unknown encoding ", encoding, ", falling back to ", h.encoding)
+		}
+	}
+
+	if v, exists := configMap["batch_n"]; exists {
+		h.batchSize = config.GetAsInt(v, DefaultHTTPBatchSize)
+	}
+
+	if v, exists := configMap["batch_bytes"]; exists {
+		h.batchBytes = config.GetAsInt(v, DefaultHTTPBatchBytes)
+	}
+
+	if v, exists := configMap["batch_timeout"]; exists {
+		if ms := config.GetAsInt(v, DefaultHTTPBatchTimeout); ms > 0 {
+			h.batchTimeout = time.Duration(ms) * time.Millisecond
+		} else {
+			h.log.Error("Invalid batch_timeout ", v, ", falling back to ", DefaultHTTPBatchTimeout)
+		}
+	}
+
+	if v, exists := configMap["retries"]; exists {
+		h.retries = config.GetAsInt(v, DefaultHTTPRetries)
+	}
+
+	if v, exists := configMap["backoff"]; exists {
+		h.backoff = time.Duration(config.GetAsInt(v, DefaultHTTPBackoff)) * time.Millisecond
+	}
+
+	if v, exists := configMap["max_backoff"]; exists {
+		h.maxBackoff = time.Duration(config.GetAsInt(v, DefaultHTTPMaxBackoff)) * time.Millisecond
+	}
+
+	if v, exists := configMap["timeout"]; exists {
+		h.client.Timeout = time.Duration(config.GetAsInt(v, DefaultHTTPTimeout)) * time.Millisecond
+	}
+
+	h.configureCommonParams(configMap)
+}
+
+// Run runs the forwarder main loop, without url every message is dropped
+func (h *HTTP) Run() {
+	h.batcher = newBatcher(h.batchSize, h.batchBytes, h.batchTimeout, h.sendBatches)
+	h.batcher.start()
+	h.batched = true
+	h.run(h.emitMsg)
+}
+
+// InternalMetrics : the base counters plus responses by status class
+func (h *HTTP) InternalMetrics() InternalMetrics {
+	m := h.BaseForwarder.InternalMetrics()
+	for class := 1; class < len(h.responses); class++ {
+		m.Counters[fmt.Sprintf("responses%dxx", class)] = float64(atomic.LoadUint64(&h.responses[class]))
+	}
+	m.Counters["requestErrors"] = float64(atomic.LoadUint64(&h.requestErrors))
+	m.Counters["requestRetries"] = float64(atomic.LoadUint64(&h.requestRetries))
+	m.Counters["batchesSent"] = float64(atomic.LoadUint64(&h.batchesSent))
+	m.Counters["batchesFailed"] = float64(atomic.LoadUint64(&h.batchesFailed))
+	m.Counters["msgsFailed"] = float64(atomic.LoadUint64(&h.msgsFailed))
+	return m
+}
+
+// emitMsg adds m to the current batch, its messages are counted as
+// sent once the batch is, or in msgsFailed if it's lost after all retries
+func (h *HTTP) emitMsg(m []byte) bool {
+	h.batcher.add(m, 1)
+	return true
+}
+
+func (h *HTTP) sendBatches(batch [][]byte) {
+	start := time.Now()
+	delivered := h.sendBatch(batch)
+	h.sendTime.Observe(time.Since(start))
+
+	if delivered {
+		atomic.AddUint64(&h.batchesSent, 1)
+		for _, msg := range batch {
+			h.countSent(len(msg))
+		}
+	} else {
+		h.log.Error("Dropping batch of ", len(batch), " messages")
+		atomic.AddUint64(&h.batchesFailed, 1)
+		atomic.AddUint64(&h.msgsFailed, uint64(len(batch)))
+	}
+}
+
+// sendBatch POSTs the batch, retrying connection errors and 5xx responses
+func (h *HTTP) sendBatch(batch [][]byte) bool {
+	body, contentType, err := h.encode(batch)
+	if err != nil {
+		h.log.Error("Failed to encode batch: ", err)
+		return false
+	}
+
+	backoff := h.backoff
+	for attempt := 0; ; attempt++ {
+		delivered, retry := h.post(body, contentType)
+		if !retry {
+			return delivered
+		}
+		if attempt >= h.retries {
+			return false
+		}
+
+		atomic.AddUint64(&h.requestRetries, 1)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > h.maxBackoff {
+			backoff = h.maxBackoff
+		}
+	}
+}
+
+// post sends a single request and tells whether it's worth retrying
+func (h *HTTP) post(body []byte, contentType string) (delivered bool, retry bool) {
+	req, err := http.NewRequest(http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		h.log.Error("Failed to build request: ", err)
+		return false, false
+	}
+
+	req.Header.Set("Content-Type", contentType)
+	for k, v := range h.headers {
+		req.Header.Set(k, v)
+	}
+
+	rsp, err := h.client.Do(req)
+	if err != nil {
+		atomic.AddUint64(&h.requestErrors, 1)
+		h.countError(requestOp(err), err)
+		h.log.Warn("Failed to send batch to HTTP endpoint: ", err)
+		return false, true
+	}
+	// drain the body so the connection can be reused
+	io.Copy(ioutil.Discard, rsp.Body)
+	rsp.Body.Close()
+
+	if class := rsp.StatusCode / 100; class > 0 && class < len(h.responses) {
+		atomic.AddUint64(&h.responses[class], 1)
+	}
+
+	switch {
+	case rsp.StatusCode >= 500:
+		h.log.Warn("HTTP endpoint responded ", rsp.Status)
+		return false, true
+	case rsp.StatusCode >= 300:
+		h.log.Error("HTTP endpoint rejected batch: ", rsp.Status)
+		return false, false
+	}
+	return true, false
+}
+
+func (h *HTTP) encode(batch [][]byte) ([]byte, string, error) {
+	if h.encoding == httpEncodingJSON {
+		msgs := make([]string, len(batch))
+		for i, msg := range batch {
+			msgs[i] = string(msg)
+		}
+		body, err := json.Marshal(msgs)
+		return body, "application/json", err
+	}
+
+	return bytes.Join(batch, []byte("\n")), "text/plain", nil
+}
+
+// requestOp tells whether a request failed connecting or afterwards
+func requestOp(err error) string {
+	if urlErr, ok := err.(*url.Error); ok {
+		if opErr, ok := urlErr.Err.(*net.OpError); ok && opErr.Op == "dial" {
+			return opDial
+		}
+	}
+	return opWrite
+}
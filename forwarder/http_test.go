@@ -0,0 +1,102 @@
+package forwarder
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+)
+
+func TestHTTPConfigureBatchTimeout(t *testing.T) {
+	cases := []struct {
+		value    interface{}
+		expected time.Duration
+	}{
+		{250.0, 250 * time.Millisecond},
+		{"250", 250 * time.Millisecond},
+		{0.0, DefaultHTTPBatchTimeout * time.Millisecond},
+		{-1.0, DefaultHTTPBatchTimeout * time.Millisecond},
+		{"0", DefaultHTTPBatchTimeout * time.Millisecond},
+	}
+
+	for _, c := range cases {
+		h := newHTTP(100, l.NewEntry(l.New())).(*HTTP)
+		h.Configure(map[string]interface{}{
+			"url":           "http://localhost/",
+			"batch_timeout": c.value,
+		})
+		if h.batchTimeout != c.expected {
+			t.Errorf("batch_timeout %#v: expected %s, got %s", c.value, c.expected, h.batchTimeout)
+		}
+	}
+}
+
+func TestHTTPCountsSentOnDelivery(t *testing.T) {
+	status := http.StatusNoContent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	logger := l.New()
+	logger.Out = ioutil.Discard
+	h := newHTTP(100, l.NewEntry(logger)).(*HTTP)
+	h.Configure(map[string]interface{}{"url": server.URL})
+
+	h.sendBatches([][]byte{[]byte("a"), []byte("bc")})
+	status = http.StatusBadRequest
+	h.sendBatches([][]byte{[]byte("d")})
+
+	expected := map[string]float64{
+		"msgsSent":      2,
+		"bytesSent":     3,
+		"msgsFailed":    1,
+		"batchesSent":   1,
+		"batchesFailed": 1,
+	}
+	counters := h.InternalMetrics().Counters
+	for name, value := range expected {
+		if counters[name] != value {
+			t.Errorf("expected %s %v, got %v", name, value, counters[name])
+		}
+	}
+}
+
+func TestHTTPConfigureURL(t *testing.T) {
+	for _, value := range []interface{}{nil, "", 8080.0} {
+		logger := l.New()
+		logger.Out = ioutil.Discard
+		h := newHTTP(100, l.NewEntry(logger)).(*HTTP)
+		configMap := map[string]interface{}{}
+		if value != nil {
+			configMap["url"] = value
+		}
+		h.Configure(configMap)
+		if h.confErr == nil {
+			t.Errorf("url %#v: expected the forwarder to be disabled", value)
+		}
+	}
+}
+
+func TestHTTPSendTimeCoversThePost(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	logger := l.New()
+	logger.Out = ioutil.Discard
+	h := newHTTP(100, l.NewEntry(logger)).(*HTTP)
+	h.Configure(map[string]interface{}{"url": server.URL})
+
+	h.sendBatches([][]byte{[]byte("a")})
+
+	sendTime := h.InternalMetrics().Histograms["sendTime"]
+	if sendTime.Count != 1 || sendTime.Sum < 0.02 {
+		t.Errorf("expected one send of at least 20ms, got %d taking %vs", sendTime.Count, sendTime.Sum)
+	}
+}
@@ -1,12 +1,16 @@
 package forwarder
 
 import (
+	"errors"
+	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Shopify/sarama"
 	l "github.com/Sirupsen/logrus"
 	"github.com/tsheasha/relayd/config"
+	"github.com/tsheasha/relayd/kafkaconfig"
 )
 
 func init() {
@@ -20,8 +24,18 @@ type Kafka struct {
 	brokers []string
 	conn    sarama.SyncProducer
 	conf    *sarama.Config
+
+	// when the producer was last tried to be created, it's created
+	// again at most every kafkaRetryInterval while it can't be
+	lastDial time.Time
+
+	// guards conn and lastDial against concurrent emissions
+	connLock sync.Mutex
 }
 
+// kafkaRetryInterval is how often a producer that couldn't be created is retried
+const kafkaRetryInterval = 5 * time.Second
+
 // newKafka returns a new Kafka forwarder
 func newKafka(
 	initialBufferSize int,
@@ -37,81 +51,186 @@ func newKafka(
 // Configure the Kafka forwarder
 func (k *Kafka) Configure(configMap map[string]interface{}) {
 	k.conf = sarama.NewConfig()
+	// required by the SyncProducer
+	k.conf.Producer.Return.Successes = true
 
-	if v, exists := configMap["acks"]; exists {
-		switch v.(string) {
-		case "0":
-			k.conf.Producer.RequiredAcks = sarama.NoResponse
-		case "1":
-			k.conf.Producer.RequiredAcks = sarama.WaitForLocal
-		case "-1":
-			k.conf.Producer.RequiredAcks = sarama.WaitForAll
-		}
+	if v, exists := configMap["brokers"]; exists {
+		k.brokers = config.GetAsSlice(v)
 	}
 
-	if v, exists := configMap["ack_timeout"]; exists {
-		k.conf.Producer.Timeout = time.Duration(config.GetAsInt(v, 1000)) * time.Millisecond
+	var errs []string
+	if err := k.configureProducer(configMap); err != nil {
+		errs = append(errs, err.Error())
 	}
 
-	if v, exists := configMap["batch_n"]; exists {
-		k.conf.Producer.Flush.MaxMessages = config.GetAsInt(v, 100)
+	errs = append(errs, kafkaconfig.Configure(k.conf, configMap)...)
+
+	if _, exists := configMap["close_timeout"]; exists {
+		k.log.Warn("close_timeout is no longer supported and is ignored, use keep_alive for TCP keep-alives")
 	}
 
-	if v, exists := configMap["batch_t"]; exists {
-		k.conf.Producer.Flush.Frequency = time.Duration(config.GetAsInt(v, 5)) * time.Second
+	if len(k.brokers) == 0 {
+		errs = append(errs, "no brokers specified")
 	}
 
-	if v, exists := configMap["brokers"]; exists {
-		k.brokers = config.GetAsSlice(v)
+	// catches the invalid combinations, e.g. idempotence without acks=all
+	if len(errs) == 0 {
+		if err := k.conf.Validate(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		k.confErr = errors.New(strings.Join(errs, "; "))
+		k.log.Error("Invalid Kafka configuration: ", k.confErr)
 	}
 
-	if v, exists := configMap["close_timeout"]; exists {
-		k.conf.Net.KeepAlive = time.Duration(config.GetAsInt(v, 1000)) * time.Millisecond
+	k.configureCommonParams(configMap)
+}
+
+// configureProducer maps the producer options onto the sarama config
+func (k *Kafka) configureProducer(configMap map[string]interface{}) error {
+	p := &k.conf.Producer
+
+	if v, exists := configMap["acks"]; exists {
+		switch strings.ToLower(fmt.Sprint(v)) {
+		case "0", "none":
+			p.RequiredAcks = sarama.NoResponse
+		case "1", "local":
+			p.RequiredAcks = sarama.WaitForLocal
+		case "-1", "all":
+			p.RequiredAcks = sarama.WaitForAll
+		default:
+			return fmt.Errorf("invalid acks %v, expected one of 0, 1, -1 or all", v)
+		}
 	}
 
 	if v, exists := configMap["compression"]; exists {
-		switch v.(string) {
+		switch strings.ToLower(fmt.Sprint(v)) {
 		case "none":
-			k.conf.Producer.Compression = sarama.CompressionNone
+			p.Compression = sarama.CompressionNone
 		case "gzip":
-			k.conf.Producer.Compression = sarama.CompressionGZIP
+			p.Compression = sarama.CompressionGZIP
 		case "snappy":
-			k.conf.Producer.Compression = sarama.CompressionSnappy
+			p.Compression = sarama.CompressionSnappy
+		case "lz4":
+			p.Compression = sarama.CompressionLZ4
+		case "zstd":
+			p.Compression = sarama.CompressionZSTD
+		default:
+			return fmt.Errorf("invalid compression %v, expected one of none, gzip, snappy, lz4 or zstd", v)
+		}
+	}
+
+	if v, exists := configMap["partitioner"]; exists {
+		switch strings.ToLower(fmt.Sprint(v)) {
+		case "hash":
+			p.Partitioner = sarama.NewHashPartitioner
+		case "random":
+			p.Partitioner = sarama.NewRandomPartitioner
+		case "roundrobin":
+			p.Partitioner = sarama.NewRoundRobinPartitioner
+		default:
+			return fmt.Errorf("invalid partitioner %v, expected one of hash, random or roundrobin", v)
+		}
+	}
+
+	if v, exists := configMap["idempotent"]; exists {
+		p.Idempotent = config.GetAsBool(v, false)
+		if p.Idempotent {
+			// sarama refuses idempotence with more than one in-flight request
+			k.conf.Net.MaxOpenRequests = 1
 		}
 	}
 
-	if v, exists := configMap["retries"]; exists {
-		k.conf.Producer.Retry.Max = config.GetAsInt(v, 5)
+	ints := []struct {
+		key  string
+		dest *int
+		min  int
+	}{
+		{"batch_n", &p.Flush.MaxMessages, 0},
+		{"batch_bytes", &p.Flush.Bytes, 0},
+		{"compression_level", &p.CompressionLevel, sarama.CompressionLevelDefault},
+		{"max_message_bytes", &p.MaxMessageBytes, 1},
+		{"retries", &p.Retry.Max, 0},
+	}
+	for _, opt := range ints {
+		if v, exists := configMap[opt.key]; exists {
+			n, err := kafkaconfig.ParseInt(opt.key, v, opt.min)
+			if err != nil {
+				return err
+			}
+			*opt.dest = n
+		}
 	}
 
-	if v, exists := configMap["stagger"]; exists {
-		k.conf.Producer.Retry.Backoff = time.Duration(config.GetAsInt(v, 1000)) * time.Millisecond
+	durations := []struct {
+		key  string
+		dest *time.Duration
+		unit time.Duration
+	}{
+		{"ack_timeout", &p.Timeout, time.Millisecond},
+		{"batch_t", &p.Flush.Frequency, time.Second},
+		{"stagger", &p.Retry.Backoff, time.Millisecond},
+	}
+	for _, opt := range durations {
+		if v, exists := configMap[opt.key]; exists {
+			n, err := kafkaconfig.ParseInt(opt.key, v, 0)
+			if err != nil {
+				return err
+			}
+			*opt.dest = time.Duration(n) * opt.unit
+		}
 	}
 
-	k.configureCommonParams(configMap)
+	return nil
 }
 
-// Run runs the forwarder main loop
+// Run runs the forwarder main loop, with an invalid configuration
+// every message is dropped
 func (k *Kafka) Run() {
+	if k.confErr == nil {
+		k.producer()
+	}
+	k.run(k.emitMsg)
+}
+
+// producer returns the producer, creating it if it doesn't exist and
+// wasn't tried within kafkaRetryInterval, nil if there's none
+func (k *Kafka) producer() sarama.SyncProducer {
+	k.connLock.Lock()
+	defer k.connLock.Unlock()
+
+	if k.conn != nil || time.Since(k.lastDial) < kafkaRetryInterval {
+		return k.conn
+	}
+
+	k.lastDial = time.Now()
 	conn, err := sarama.NewSyncProducer(k.brokers, k.conf)
 	if err != nil {
+		k.countError(opDial, err)
 		k.log.Error("Failed to create Kafka producer ", err)
-		return
+		return nil
 	}
 
 	k.conn = conn
-	k.run(k.emitMsg)
+	return conn
 }
 
 func (k *Kafka) emitMsg(m []byte) bool {
+	conn := k.producer()
+	if conn == nil {
+		return false
+	}
 
 	topic := strings.SplitN(string(m), ":", 1)[0]
 	msg := &sarama.ProducerMessage{
 		Topic: topic,
 		Value: sarama.ByteEncoder(m),
 	}
-	partition, offset, err := k.conn.SendMessage(msg)
+	partition, offset, err := conn.SendMessage(msg)
 	if err != nil {
+		k.countError(opWrite, err)
 		k.log.Error("Failed to send message to Kafka endpoint ", err)
 		return false
 	}
@@ -0,0 +1,202 @@
+package forwarder
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"github.com/tsheasha/relayd/message"
+)
+
+// processor types, set with the "type" key of a stage
+const (
+	processorDrop        = "drop"
+	processorReplace     = "replace"
+	processorPrepend     = "prepend"
+	processorAppend      = "append"
+	processorHostname    = "hostname"
+	processorTrim        = "trim"
+	processorLineEndings = "line_endings"
+)
+
+// processors is the chain messages go through before being sent, e.g.
+//
+//	"processors": [
+//		{"type": "drop", "pattern": "^DEBUG"},
+//		{"type": "replace", "pattern": "password=\\S+", "replacement": "password=***"},
+//		{"type": "hostname", "separator": " "},
+//		{"type": "line_endings", "to": "crlf"}
+//	]
+//
+// Stages run in order. A stage with routes only processes the messages
+// matching them, the others pass it untouched.
+type processors []*stage
+
+// stage is a step of the chain and its counters
+type stage struct {
+	name    string
+	routes  routes
+	process func([]byte) ([]byte, bool)
+
+	msgsIn       uint64
+	msgsModified uint64
+	msgsDropped  uint64
+}
+
+// newProcessors builds the chain, every stage must be valid: skipping one
+// would change what's relayed and shift the names of the later stages
+func newProcessors(value interface{}) (processors, error) {
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected processors to be a list of stages")
+	}
+
+	var chain processors
+	for i, item := range list {
+		stageMap, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expected processor %d to be a map", i)
+		}
+
+		s, err := newStage(i, stageMap)
+		if err != nil {
+			return nil, fmt.Errorf("invalid processor %d: %s", i, err)
+		}
+		chain = append(chain, s)
+	}
+	return chain, nil
+}
+
+// newStage builds the stage at position index of the chain, it's named
+// after both for its counters, e.g. processor0Drop or processor1LineEndings
+func newStage(index int, stageMap map[string]interface{}) (*stage, error) {
+	str := func(key string) string {
+		v, _ := stageMap[key].(string)
+		return v
+	}
+
+	// an empty pattern matches every message
+	pattern := func() (*regexp.Regexp, error) {
+		if str("pattern") == "" {
+			return nil, fmt.Errorf("%s needs a pattern", str("type"))
+		}
+		return regexp.Compile(str("pattern"))
+	}
+
+	kind := str("type")
+	s := new(stage)
+	s.name = fmt.Sprintf("processor%d", index)
+	for _, word := range strings.Split(kind, "_") {
+		if word != "" {
+			s.name += strings.ToUpper(word[:1]) + word[1:]
+		}
+	}
+
+	if r, exists := stageMap["routes"]; exists {
+		s.routes = newRoutes(r)
+	}
+
+	switch kind {
+	case processorDrop:
+		re, err := pattern()
+		if err != nil {
+			return nil, err
+		}
+		s.process = func(payload []byte) ([]byte, bool) {
+			return payload, !re.Match(payload)
+		}
+
+	case processorReplace:
+		re, err := pattern()
+		if err != nil {
+			return nil, err
+		}
+		replacement := []byte(str("replacement"))
+		s.process = func(payload []byte) ([]byte, bool) {
+			return re.ReplaceAll(payload, replacement), true
+		}
+
+	case processorPrepend, processorAppend, processorHostname:
+		text := str("text")
+		if kind == processorHostname {
+			host, err := os.Hostname()
+			if err != nil {
+				return nil, err
+			}
+			text = host + " "
+			if _, exists := stageMap["separator"]; exists {
+				text = host + str("separator")
+			}
+		}
+		appending := kind == processorAppend
+		s.process = func(payload []byte) ([]byte, bool) {
+			// the payload is shared with other forwarders, build a new one
+			out := make([]byte, 0, len(payload)+len(text))
+			if appending {
+				return append(append(out, payload...), text...), true
+			}
+			return append(append(out, text...), payload...), true
+		}
+
+	case processorTrim:
+		s.process = func(payload []byte) ([]byte, bool) {
+			return bytes.TrimSpace(payload), true
+		}
+
+	case processorLineEndings:
+		crlf, lf := []byte("\r\n"), []byte("\n")
+		switch str("to") {
+		case "lf":
+			s.process = func(payload []byte) ([]byte, bool) {
+				return bytes.Replace(payload, crlf, lf, -1), true
+			}
+		case "crlf":
+			s.process = func(payload []byte) ([]byte, bool) {
+				// normalize first so existing CRLFs don't get a second CR
+				return bytes.Replace(bytes.Replace(payload, crlf, lf, -1), lf, crlf, -1), true
+			}
+		default:
+			return nil, fmt.Errorf("unknown line endings %q, expected lf or crlf", str("to"))
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown type %q", kind)
+	}
+	return s, nil
+}
+
+// run passes the payload of msg through every stage, it returns the
+// payload to send and false if a stage dropped the message
+func (chain processors) run(msg *message.Message) ([]byte, bool) {
+	payload := msg.Payload
+	for _, s := range chain {
+		if !s.routes.match(msg) {
+			continue
+		}
+
+		atomic.AddUint64(&s.msgsIn, 1)
+		out, keep := s.process(payload)
+		if !keep {
+			atomic.AddUint64(&s.msgsDropped, 1)
+			return nil, false
+		}
+		if !bytes.Equal(out, payload) {
+			atomic.AddUint64(&s.msgsModified, 1)
+		}
+		payload = out
+	}
+	return payload, true
+}
+
+// addCounters adds the counters of every stage to counters,
+// prefixed with the stage's position and type
+func (chain processors) addCounters(counters map[string]float64) {
+	for _, s := range chain {
+		counters[s.name+"MsgsIn"] = float64(atomic.LoadUint64(&s.msgsIn))
+		counters[s.name+"MsgsModified"] = float64(atomic.LoadUint64(&s.msgsModified))
+		counters[s.name+"MsgsDropped"] = float64(atomic.LoadUint64(&s.msgsDropped))
+	}
+}
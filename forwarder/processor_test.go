@@ -0,0 +1,160 @@
+package forwarder
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	l "github.com/Sirupsen/logrus"
+	"github.com/tsheasha/relayd/message"
+)
+
+// newTestProcessors builds the chain of a JSON list of stages
+func newTestProcessors(t *testing.T, stages string) (processors, error) {
+	var value interface{}
+	if err := json.Unmarshal([]byte(stages), &value); err != nil {
+		t.Fatal(err)
+	}
+	return newProcessors(value)
+}
+
+func TestProcessors(t *testing.T) {
+	host, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		stage    string
+		payload  string
+		expected string
+		keep     bool
+	}{
+		{"drop match", `{"type": "drop", "pattern": "^DEBUG"}`, "DEBUG x", "", false},
+		{"drop no match", `{"type": "drop", "pattern": "^DEBUG"}`, "INFO x", "INFO x", true},
+		{"replace", `{"type": "replace", "pattern": "password=\\S+", "replacement": "password=***"}`,
+			"login password=hunter2 ok", "login password=*** ok", true},
+		{"replace without replacement", `{"type": "replace", "pattern": "\\d"}`, "a1b2", "ab", true},
+		{"prepend", `{"type": "prepend", "text": "> "}`, "x", "> x", true},
+		{"append", `{"type": "append", "text": " <"}`, "x", "x <", true},
+		{"hostname", `{"type": "hostname"}`, "x", host + " x", true},
+		{"hostname separator", `{"type": "hostname", "separator": ": "}`, "x", host + ": x", true},
+		{"trim", `{"type": "trim"}`, " \tx \n", "x", true},
+		{"line endings lf", `{"type": "line_endings", "to": "lf"}`, "a\r\nb\n", "a\nb\n", true},
+		{"line endings crlf", `{"type": "line_endings", "to": "crlf"}`, "a\r\nb\n", "a\r\nb\r\n", true},
+		{"routed", `{"type": "append", "text": "!", "routes": {"source": "UDP"}}`, "x", "x!", true},
+		{"not routed", `{"type": "append", "text": "!", "routes": {"source": "TCP"}}`, "x", "x", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chain, err := newTestProcessors(t, "["+test.stage+"]")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			msg := message.New([]byte(test.payload))
+			msg.Source = "UDP"
+			payload, keep := chain.run(msg)
+			if keep != test.keep || string(payload) != test.expected {
+				t.Errorf("expected %q, %v, got %q, %v", test.expected, test.keep, payload, keep)
+			}
+		})
+	}
+}
+
+func TestProcessorsCounters(t *testing.T) {
+	chain, err := newTestProcessors(t, `[
+		{"type": "trim"},
+		{"type": "drop", "pattern": "^DEBUG"},
+		{"type": "line_endings", "to": "crlf"}
+	]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, payload := range []string{"DEBUG x", " a\n", "b"} {
+		chain.run(message.New([]byte(payload)))
+	}
+
+	expected := map[string]float64{
+		"processor0TrimMsgsIn":              3,
+		"processor0TrimMsgsModified":        1,
+		"processor1DropMsgsIn":              3,
+		"processor1DropMsgsDropped":         1,
+		"processor2LineEndingsMsgsIn":       2,
+		"processor2LineEndingsMsgsModified": 0,
+	}
+	counters := make(map[string]float64)
+	chain.addCounters(counters)
+	for name, value := range expected {
+		if counters[name] != value {
+			t.Errorf("expected %s %v, got %v", name, value, counters[name])
+		}
+	}
+}
+
+func TestProcessorsErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		stages string
+		err    string
+	}{
+		{"not a list", `{"type": "trim"}`, "list of stages"},
+		{"not a map", `["trim"]`, "processor 0 to be a map"},
+		{"unknown type", `[{"type": "upper"}]`, "unknown type"},
+		{"drop without pattern", `[{"type": "drop"}]`, "needs a pattern"},
+		{"drop with empty pattern", `[{"type": "drop", "pattern": ""}]`, "needs a pattern"},
+		{"replace without pattern", `[{"type": "replace", "replacement": "x"}]`, "needs a pattern"},
+		{"invalid pattern", `[{"type": "drop", "pattern": "("}]`, "missing closing )"},
+		{"line endings", `[{"type": "line_endings", "to": "cr"}]`, "unknown line endings"},
+		{"later stage", `[{"type": "trim"}, {"type": "drop"}]`, "invalid processor 1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := newTestProcessors(t, test.stages)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("expected an error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestInvalidProcessorsDisableForwarder(t *testing.T) {
+	logger := l.New()
+	logger.Out = ioutil.Discard
+	f := newTCP(100, l.NewEntry(logger)).(*TCP)
+	f.Configure(map[string]interface{}{
+		"server":     "localhost",
+		"port":       "1",
+		"processors": []interface{}{map[string]interface{}{"type": "drop"}},
+	})
+	if f.confErr == nil {
+		t.Fatal("expected invalid processors to disable the forwarder")
+	}
+
+	// every message is dropped, none reaches emitFunc
+	c := make(chan *message.Message, 1)
+	failed := false
+	msg := message.New([]byte("x"))
+	msg.OnDone(func(m *message.Message, ok bool) { failed = !ok })
+	c <- msg
+	close(c)
+
+	var highWater uint64
+	f.listenForMsgs(func([]byte) bool {
+		t.Error("expected no emission")
+		return true
+	}, c, &highWater)
+
+	if dropped := f.InternalMetrics().Counters["msgsDropped"]; dropped != 1 {
+		t.Errorf("expected 1 dropped message, got %v", dropped)
+	}
+	if !failed {
+		t.Error("expected the message to be failed")
+	}
+}
@@ -0,0 +1,64 @@
+package forwarder
+
+import (
+	"time"
+
+	"github.com/tsheasha/relayd/config"
+)
+
+// Defaults of the wait between dials, in ms
+const (
+	DefaultRedialBackoff    = 100
+	DefaultRedialMaxBackoff = 10000
+)
+
+// redial paces the dials of a connection after failures, the wait doubles
+// with every failure in a row from backoff up to maxBackoff. It isn't safe
+// for concurrent use, forwarders guard it along with their connection.
+type redial struct {
+	backoff    time.Duration
+	maxBackoff time.Duration
+
+	wait time.Duration
+	next time.Time
+}
+
+func newRedial() redial {
+	return redial{
+		backoff:    DefaultRedialBackoff * time.Millisecond,
+		maxBackoff: DefaultRedialMaxBackoff * time.Millisecond,
+	}
+}
+
+// configure reads the backoff and max_backoff options
+func (r *redial) configure(configMap map[string]interface{}) {
+	if v, exists := configMap["backoff"]; exists {
+		r.backoff = time.Duration(config.GetAsInt(v, DefaultRedialBackoff)) * time.Millisecond
+	}
+
+	if v, exists := configMap["max_backoff"]; exists {
+		r.maxBackoff = time.Duration(config.GetAsInt(v, DefaultRedialMaxBackoff)) * time.Millisecond
+	}
+}
+
+// ready tells whether it's time to dial
+func (r *redial) ready() bool {
+	return !time.Now().Before(r.next)
+}
+
+// failed delays the next dial
+func (r *redial) failed() {
+	r.wait *= 2
+	if r.wait < r.backoff {
+		r.wait = r.backoff
+	}
+	if r.wait > r.maxBackoff {
+		r.wait = r.maxBackoff
+	}
+	r.next = time.Now().Add(r.wait)
+}
+
+// succeeded resets the wait after a successful dial
+func (r *redial) succeeded() {
+	r.wait = 0
+}
@@ -0,0 +1,68 @@
+package forwarder
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/tsheasha/relayd/message"
+)
+
+// routes maps message attributes to the values a forwarder accepts, e.g.
+//
+//	"routes": {"facility": ["auth", "authpriv"], "hostname": ["web*"]}
+//
+// A message is relayed if it matches every attribute. A value ending
+// with * matches on prefix, values that aren't strings, e.g. partition
+// numbers, match their string form. No routes means every message is relayed.
+// The source, framing and peer of a message can be routed on too, see
+// message.Field.
+type routes map[string][]string
+
+func newRoutes(value interface{}) routes {
+	r := make(routes)
+	asMap, ok := value.(map[string]interface{})
+	if !ok {
+		defaultLog.Error("Expected routes to be a map of attribute to values, ignoring them")
+		return r
+	}
+
+	for attribute, values := range asMap {
+		switch values := values.(type) {
+		case []interface{}:
+			patterns := make([]string, len(values))
+			for i, value := range values {
+				patterns[i] = fmt.Sprint(value)
+			}
+			r[attribute] = patterns
+		case []string:
+			r[attribute] = values
+		default:
+			// a single value doesn't have to be wrapped in a list
+			r[attribute] = []string{fmt.Sprint(values)}
+		}
+	}
+	return r
+}
+
+func (r routes) match(msg *message.Message) bool {
+	for attribute, patterns := range r {
+		value, exists := msg.Field(attribute)
+		if !exists || !matchAny(patterns, value) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "*") {
+			if strings.HasPrefix(value, pattern[:len(pattern)-1]) {
+				return true
+			}
+		} else if pattern == value {
+			return true
+		}
+	}
+	return false
+}
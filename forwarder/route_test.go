@@ -0,0 +1,64 @@
+package forwarder
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/tsheasha/relayd/message"
+)
+
+func TestRoutes(t *testing.T) {
+	var value interface{}
+	if err := json.Unmarshal([]byte(`{
+		"facility": ["auth", "authpriv"],
+		"hostname": "web*",
+		"partition": [0, 1]
+	}`), &value); err != nil {
+		t.Fatal(err)
+	}
+	r := newRoutes(value)
+
+	tests := []struct {
+		attributes map[string]string
+		match      bool
+	}{
+		{map[string]string{"facility": "auth", "hostname": "web1", "partition": "0"}, true},
+		{map[string]string{"facility": "authpriv", "hostname": "web", "partition": "1"}, true},
+		{map[string]string{"facility": "kern", "hostname": "web1", "partition": "0"}, false},
+		{map[string]string{"facility": "auth", "hostname": "db1", "partition": "0"}, false},
+		{map[string]string{"facility": "auth", "hostname": "web1", "partition": "2"}, false},
+		{map[string]string{"facility": "auth", "hostname": "web1"}, false},
+	}
+
+	for _, test := range tests {
+		msg := message.New(nil)
+		msg.Attributes = test.attributes
+		if r.match(msg) != test.match {
+			t.Errorf("%v: expected match %v", test.attributes, test.match)
+		}
+	}
+}
+
+func TestRoutesMetadata(t *testing.T) {
+	r := newRoutes(map[string]interface{}{"source": "Syslog", "framing": []string{"rfc6587", "newline"}})
+
+	msg := message.New(nil)
+	msg.Source = "Syslog"
+	msg.Framing = "newline"
+	if !r.match(msg) {
+		t.Error("expected the source and framing to match")
+	}
+
+	msg.Source = "UDP"
+	if r.match(msg) {
+		t.Error("expected another source not to match")
+	}
+}
+
+func TestRoutesEmpty(t *testing.T) {
+	for _, value := range []interface{}{map[string]interface{}{}, "not a map"} {
+		if !newRoutes(value).match(message.New(nil)) {
+			t.Errorf("%#v: expected every message to be relayed", value)
+		}
+	}
+}
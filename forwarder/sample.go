@@ -0,0 +1,57 @@
+package forwarder
+
+import (
+	"errors"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"sync/atomic"
+
+	"github.com/tsheasha/relayd/message"
+)
+
+// sampler relays a fraction of the messages, set with sample_rate.
+// With sample_key the messages are sampled on a hash of that field
+// (see message.Field), so the same key is always either relayed or
+// not, on every relayd running with the same rate. Messages without
+// the field, counted in keyMissing, or without sample_key, are sampled
+// at random.
+type sampler struct {
+	rate float64
+	key  string
+
+	keyMissing uint64
+}
+
+func newSampler(rate float64, key string) (*sampler, error) {
+	if rate <= 0 || rate > 1 || math.IsNaN(rate) {
+		return nil, errors.New("expected sample_rate to be within (0, 1]")
+	}
+	return &sampler{rate: rate, key: key}, nil
+}
+
+// keep tells whether msg is in the sample, a nil sampler keeps everything
+func (s *sampler) keep(msg *message.Message) bool {
+	if s == nil || s.rate == 1 {
+		return true
+	}
+
+	if s.key != "" {
+		if value, exists := msg.Field(s.key); exists {
+			h := fnv.New64a()
+			h.Write([]byte(value))
+			// the hash spread over [0, 1)
+			return float64(h.Sum64())/(1<<64) < s.rate
+		}
+		atomic.AddUint64(&s.keyMissing, 1)
+	}
+	return rand.Float64() < s.rate
+}
+
+// addCounters adds the messages sampled at random for lack of the
+// sample_key field to counters, if a key is set
+func (s *sampler) addCounters(counters map[string]float64) {
+	if s != nil && s.key != "" {
+		counters["msgsSampleKeyMissing"] = float64(atomic.LoadUint64(&s.keyMissing))
+	}
+}
@@ -0,0 +1,74 @@
+package forwarder
+
+import (
+	"io/ioutil"
+	"math"
+	"testing"
+
+	l "github.com/Sirupsen/logrus"
+	"github.com/tsheasha/relayd/message"
+)
+
+func TestNewSampler(t *testing.T) {
+	for _, rate := range []float64{0.01, 1} {
+		if _, err := newSampler(rate, ""); err != nil {
+			t.Errorf("rate %v: %s", rate, err)
+		}
+	}
+	for _, rate := range []float64{0, -0.5, 1.5, math.NaN()} {
+		if _, err := newSampler(rate, ""); err == nil {
+			t.Errorf("rate %v: expected an error", rate)
+		}
+	}
+}
+
+func TestInvalidSampleRateDisablesForwarder(t *testing.T) {
+	for _, rate := range []interface{}{"1%", 2.0, true} {
+		logger := l.New()
+		logger.Out = ioutil.Discard
+		f := newTCP(100, l.NewEntry(logger)).(*TCP)
+		f.Configure(map[string]interface{}{"server": "localhost", "port": "1", "sample_rate": rate})
+		if f.confErr == nil {
+			t.Errorf("sample_rate %#v: expected the forwarder to be disabled", rate)
+		}
+	}
+}
+
+func TestSamplerKey(t *testing.T) {
+	s, err := newSampler(0.5, "metric")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kept := 0
+	for i := 0; i < 100; i++ {
+		msg := message.New(nil)
+		msg.SetAttribute("metric", "servers.web1.load")
+		if s.keep(msg) {
+			kept++
+		}
+	}
+	if kept != 0 && kept != 100 {
+		t.Errorf("expected a key to be always or never kept, kept %d of 100", kept)
+	}
+
+	for i := 0; i < 3; i++ {
+		s.keep(message.New(nil))
+	}
+	counters := make(map[string]float64)
+	s.addCounters(counters)
+	if counters["msgsSampleKeyMissing"] != 3 {
+		t.Errorf("expected 3 messages without the key, got %v", counters["msgsSampleKeyMissing"])
+	}
+}
+
+func TestSamplerWithoutKeyHasNoMissingCounter(t *testing.T) {
+	s, _ := newSampler(0.5, "")
+	s.keep(message.New(nil))
+
+	counters := make(map[string]float64)
+	s.addCounters(counters)
+	if _, exists := counters["msgsSampleKeyMissing"]; exists {
+		t.Error("expected no counter without sample_key")
+	}
+}
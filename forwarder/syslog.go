@@ -0,0 +1,223 @@
+package forwarder
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+	"github.com/tsheasha/relayd/config"
+	"github.com/tsheasha/relayd/syslog"
+)
+
+// transports, set with the "protocol" key
+const (
+	syslogUDP = "udp"
+	syslogTCP = "tcp"
+	syslogTLS = "tls"
+)
+
+func init() {
+	RegisterForwarder("Syslog", newSyslog)
+}
+
+// Syslog forwarder wraps every message in an RFC 5424 header and sends it
+// over UDP, or over TCP/TLS with octet counting framing (RFC 6587). The
+// connection is dialed again after a write failed.
+type Syslog struct {
+	BaseForwarder
+	server    string
+	port      string
+	protocol  string
+	header    syslog.Header
+	tlsConfig *tls.Config
+
+	// nil until dialed and after a failure
+	conn net.Conn
+
+	// when to dial again after a failure
+	redial redial
+
+	// keeps the frames of concurrent emissions from interleaving,
+	// and guards the connection
+	writeLock sync.Mutex
+}
+
+// newSyslog returns a new Syslog forwarder
+func newSyslog(
+	initialBufferSize int,
+	log *l.Entry) Forwarder {
+
+	s := new(Syslog)
+	s.name = "Syslog"
+
+	s.maxBufferSize = initialBufferSize
+	s.log = log
+	s.redial = newRedial()
+
+	s.protocol = syslogUDP
+	s.header.Facility, _ = syslog.FacilityCode("user")
+	s.header.Severity, _ = syslog.SeverityCode("notice")
+	s.header.Hostname, _ = os.Hostname()
+	s.header.AppName = "relayd"
+	s.header.ProcID = strconv.Itoa(os.Getpid())
+	return s
+}
+
+// Configure the Syslog forwarder
+func (s *Syslog) Configure(configMap map[string]interface{}) {
+	if server, exists := configMap["server"]; exists {
+		s.server = fmt.Sprint(server)
+	} else {
+		s.log.Error("There was no server specified, there won't be any emissions")
+		s.confErr = errors.New("no server specified")
+	}
+
+	if port, exists := configMap["port"]; exists {
+		s.port = fmt.Sprint(port)
+	} else {
+		s.log.Error("There was no port specified , there won't be any emissions")
+		s.confErr = errors.New("no port specified")
+	}
+
+	if protocol, exists := configMap["protocol"]; exists {
+		switch name := fmt.Sprint(protocol); name {
+		case syslogUDP, syslogTCP, syslogTLS:
+			s.protocol = name
+		default:
+			s.log.Error("Unknown protocol ", protocol, ", falling back to ", s.protocol)
+		}
+	}
+
+	if facility, exists := configMap["facility"]; exists {
+		if code, ok := syslog.FacilityCode(fmt.Sprint(facility)); ok {
+			s.header.Facility = code
+		} else {
+			s.log.Error("Unknown facility ", facility, ", falling back to ", syslog.Facilities[s.header.Facility])
+		}
+	}
+
+	if severity, exists := configMap["severity"]; exists {
+		if code, ok := syslog.SeverityCode(fmt.Sprint(severity)); ok {
+			s.header.Severity = code
+		} else {
+			s.log.Error("Unknown severity ", severity, ", falling back to ", syslog.Severities[s.header.Severity])
+		}
+	}
+
+	if hostname, exists := configMap["hostname"]; exists {
+		s.header.Hostname = fmt.Sprint(hostname)
+	}
+
+	if appName, exists := configMap["appname"]; exists {
+		s.header.AppName = fmt.Sprint(appName)
+	}
+
+	if msgID, exists := configMap["msgid"]; exists {
+		s.header.MsgID = fmt.Sprint(msgID)
+	}
+
+	s.redial.configure(configMap)
+
+	if s.protocol == syslogTLS {
+		// TLS is implied by the protocol, the tls_* keys only tune it.
+		// configMap is shared with the rest of the config, so copy it.
+		tlsMap := make(map[string]interface{}, len(configMap)+1)
+		for key, value := range configMap {
+			tlsMap[key] = value
+		}
+		tlsMap["tls"] = "true"
+		tlsConfig, err := config.GetTLSClientConfig(tlsMap)
+		if err != nil {
+			s.log.Error("Invalid TLS configuration, there won't be any emissions: ", err)
+			s.confErr = err
+		} else if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = s.server
+		}
+		s.tlsConfig = tlsConfig
+	}
+
+	s.configureCommonParams(configMap)
+}
+
+// Run runs the forwarder main loop, with an invalid configuration
+// every message is dropped
+func (s *Syslog) Run() {
+	if s.confErr == nil {
+		s.writeLock.Lock()
+		s.dial()
+		s.writeLock.Unlock()
+	}
+	s.run(s.emitMsg)
+}
+
+// dial connects to the remote host unless it's too early after a failure,
+// it's called with writeLock held
+func (s *Syslog) dial() bool {
+	if !s.redial.ready() {
+		return false
+	}
+
+	address := net.JoinHostPort(s.server, s.port)
+
+	var conn net.Conn
+	var err error
+	switch s.protocol {
+	case syslogTLS:
+		conn, err = tls.Dial("tcp", address, s.tlsConfig)
+	default:
+		conn, err = net.Dial(s.protocol, address)
+	}
+	if err != nil {
+		s.countError(opDial, err)
+		s.log.Error("Could not connect to remote syslog host: ", err)
+		s.redial.failed()
+		return false
+	}
+
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetKeepAlive(true)
+		tcp.SetKeepAlivePeriod(time.Duration(s.KeepAliveInterval()) * time.Second)
+	}
+
+	s.conn = conn
+	s.redial.succeeded()
+	return true
+}
+
+func (s *Syslog) emitMsg(m []byte) bool {
+	frame := make([]byte, 0, len(m)+128)
+	frame = syslog.AppendRFC5424(frame, &s.header, time.Now(), m)
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	if s.conn == nil && !s.dial() {
+		return false
+	}
+
+	var err error
+	if s.protocol == syslogUDP {
+		_, err = s.conn.Write(frame)
+	} else {
+		// octet counting: "LEN SP MSG"
+		buffers := net.Buffers{[]byte(strconv.Itoa(len(frame)) + " "), frame}
+		_, err = buffers.WriteTo(s.conn)
+	}
+
+	if err != nil {
+		s.countError(opWrite, err)
+		s.log.Error("Failed to send message to syslog endpoint, reconnecting: ", err)
+		s.conn.Close()
+		s.conn = nil
+		s.redial.failed()
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,138 @@
+package forwarder
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+	"github.com/tsheasha/relayd/syslog"
+)
+
+func newTestSyslog(configMap map[string]interface{}) *Syslog {
+	logger := l.New()
+	logger.Out = ioutil.Discard
+	s := newSyslog(100, l.NewEntry(logger)).(*Syslog)
+	s.Configure(configMap)
+	return s
+}
+
+func TestSyslogConfigureNonStrings(t *testing.T) {
+	s := newTestSyslog(map[string]interface{}{
+		"server":   "localhost",
+		"port":     514.0,
+		"protocol": 6.0,
+		"facility": 16.0,
+		"severity": []interface{}{"err"},
+		"hostname": 1.0,
+		"msgid":    true,
+	})
+
+	if s.confErr != nil {
+		t.Fatal(s.confErr)
+	}
+	if s.port != "514" || s.protocol != syslogUDP || s.header.Hostname != "1" || s.header.MsgID != "true" {
+		t.Errorf("unexpected configuration %s %s %+v", s.port, s.protocol, s.header)
+	}
+	if s.header.Facility != 1 || s.header.Severity != 5 {
+		t.Errorf("expected invalid facility and severity to keep user.notice, got %d.%d", s.header.Facility, s.header.Severity)
+	}
+}
+
+func TestSyslogDropsWithoutServer(t *testing.T) {
+	if s := newTestSyslog(map[string]interface{}{"port": "514"}); s.confErr == nil {
+		t.Fatal("expected a missing server to disable the forwarder")
+	}
+}
+
+// readSyslogFrame accepts a connection on ln and returns the message of its
+// first octet counted frame, the connection is closed afterwards
+func readSyslogFrame(ln net.Listener) (string, error) {
+	conn, err := ln.Accept()
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	length, err := reader.ReadString(' ')
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+	if err != nil {
+		return "", err
+	}
+
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(reader, frame); err != nil {
+		return "", err
+	}
+	m, err := syslog.Parse(frame)
+	if err != nil {
+		return "", err
+	}
+	return string(m.Msg), nil
+}
+
+func TestSyslogRedialsAfterWriteFailure(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	s := newTestSyslog(map[string]interface{}{
+		"server":      host,
+		"port":        port,
+		"protocol":    "tcp",
+		"backoff":     10,
+		"max_backoff": 20,
+	})
+
+	if !s.emitMsg([]byte("first")) {
+		t.Fatal("expected the first message to be sent")
+	}
+	if msg, err := readSyslogFrame(ln); err != nil || msg != "first" {
+		t.Fatalf("expected first, got %q, %v", msg, err)
+	}
+
+	accepted := make(chan string)
+	go func() {
+		msg, err := readSyslogFrame(ln)
+		if err != nil {
+			msg = err.Error()
+		}
+		accepted <- msg
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	failed := false
+	for time.Now().Before(deadline) {
+		if !s.emitMsg([]byte("again")) {
+			failed = true
+		} else if failed {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !failed {
+		t.Fatal("expected a write to the closed connection to fail")
+	}
+
+	select {
+	case msg := <-accepted:
+		if msg != "again" {
+			t.Errorf("expected again, got %q", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the forwarder to dial again")
+	}
+}
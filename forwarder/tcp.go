@@ -1,23 +1,41 @@
 package forwarder
 
 import (
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"net"
+	"sync"
 	"time"
 
 	l "github.com/Sirupsen/logrus"
 	"github.com/mikioh/tcp"
+	"github.com/tsheasha/relayd/config"
 )
 
 func init() {
 	RegisterForwarder("TCP", newTCP)
 }
 
-// TCP forwarder
+// TCP forwarder, the connection is dialed again after a write failed,
+// waiting for longer after every failure in a row
 type TCP struct {
 	BaseForwarder
-	conn   *net.TCPConn
-	server string
-	port   string
+	server    string
+	port      string
+	framing   string
+	tlsConfig *tls.Config
+
+	// what messages are written to, the connection or its TLS session,
+	// nil until dialed and after a failure
+	stream net.Conn
+
+	// when to dial again after a failure
+	redial redial
+
+	// keeps the frames of concurrent emissions from interleaving,
+	// and guards the connection
+	writeLock sync.Mutex
 }
 
 // newTCP returns a new TCP forwarder
@@ -30,56 +48,115 @@ func newTCP(
 
 	t.maxBufferSize = initialBufferSize
 	t.log = log
+	t.redial = newRedial()
 	return t
 }
 
 // Configure the TCP forwarder
 func (t *TCP) Configure(configMap map[string]interface{}) {
 	if server, exists := configMap["server"]; exists {
-		t.server = server.(string)
+		t.server = fmt.Sprint(server)
 	} else {
 		t.log.Error("There was no server specified, there won't be any emissions")
+		t.confErr = errors.New("no server specified")
 	}
 
 	if port, exists := configMap["port"]; exists {
-		t.port = port.(string)
+		t.port = fmt.Sprint(port)
 	} else {
 		t.log.Error("There was no port specified , there won't be any emissions")
+		t.confErr = errors.New("no port specified")
+	}
+	t.framing = t.configureFraming(configMap)
+
+	t.redial.configure(configMap)
+
+	tlsConfig, err := config.GetTLSClientConfig(configMap)
+	if err != nil {
+		t.log.Error("Invalid TLS configuration, there won't be any emissions: ", err)
+		t.confErr = err
+	} else if tlsConfig != nil && tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = t.server
 	}
+	t.tlsConfig = tlsConfig
+
 	t.configureCommonParams(configMap)
 }
 
-// Run runs the forwarder main loop
+// Run runs the forwarder main loop, with an invalid configuration
+// every message is dropped
 func (t *TCP) Run() {
-	var c *tcp.Conn
-	var conn net.Conn
-	var err error
-	conn, err = net.Dial("tcp", t.server+":"+t.port)
+	if t.confErr == nil {
+		t.writeLock.Lock()
+		t.dial()
+		t.writeLock.Unlock()
+	}
+	t.run(t.emitMsg)
+}
+
+// dial connects to the remote host unless it's too early after a failure,
+// it's called with writeLock held
+func (t *TCP) dial() bool {
+	if !t.redial.ready() {
+		return false
+	}
+
+	stream, err := t.connect()
 	if err != nil {
-		t.log.Error("Could not connect to remote TCP host")
-		return
+		t.countError(opDial, err)
+		t.log.Error("Could not connect to remote TCP host: ", err)
+		t.redial.failed()
+		return false
 	}
 
-	c, err = tcp.NewConn(conn)
+	t.stream = stream
+	t.redial.succeeded()
+	return true
+}
+
+// connect dials the remote host and, with TLS, completes the handshake
+func (t *TCP) connect() (net.Conn, error) {
+	conn, err := net.Dial("tcp", net.JoinHostPort(t.server, t.port))
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := tcp.NewConn(conn)
 	if err != nil {
-		t.log.Error("Could not cretae TCPConn")
 		conn.Close()
-		return
+		return nil, err
 	}
 
 	c.Cork()
-	t.conn = &c.TCPConn
-	t.conn.SetKeepAlive(true)
-	t.conn.SetKeepAlivePeriod(time.Duration(t.KeepAliveInterval()) * time.Second)
+	c.SetKeepAlive(true)
+	c.SetKeepAlivePeriod(time.Duration(t.KeepAliveInterval()) * time.Second)
 
-	t.run(t.emitMsg)
+	if t.tlsConfig == nil {
+		return &c.TCPConn, nil
+	}
+
+	session := tls.Client(&c.TCPConn, t.tlsConfig)
+	if err := session.Handshake(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake failed: %s", err)
+	}
+	return session, nil
 }
 
 func (t *TCP) emitMsg(m []byte) bool {
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
 
-	_, err := t.conn.Write(m)
-	if err != nil {
-		t.log.Error("Failed to send message to TCP endpoint")
+	if t.stream == nil && !t.dial() {
+		return false
+	}
+
+	if err := writeFrame(t.stream, t.framing, m); err != nil {
+		t.countError(opWrite, err)
+		t.log.Error("Failed to send message to TCP endpoint, reconnecting: ", err)
+		t.stream.Close()
+		t.stream = nil
+		t.redial.failed()
 		return false
 	}
 
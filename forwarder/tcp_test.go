@@ -0,0 +1,96 @@
+package forwarder
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+)
+
+func newTestTCP(t *testing.T, configMap map[string]interface{}) *TCP {
+	logger := l.New()
+	logger.Out = ioutil.Discard
+	f := newTCP(100, l.NewEntry(logger)).(*TCP)
+	f.Configure(configMap)
+	return f
+}
+
+// readLine accepts a connection on ln and returns its first line, the
+// connection is closed afterwards
+func readLine(ln net.Listener) (string, error) {
+	conn, err := ln.Accept()
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return bufio.NewReader(conn).ReadString('\n')
+}
+
+func TestTCPRedialsAfterWriteFailure(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	f := newTestTCP(t, map[string]interface{}{
+		"server":      host,
+		"port":        port,
+		"framing":     "newline",
+		"backoff":     10,
+		"max_backoff": 20,
+	})
+
+	if !f.emitMsg([]byte("first")) {
+		t.Fatal("expected the first message to be sent")
+	}
+	if line, err := readLine(ln); err != nil || line != "first\n" {
+		t.Fatalf("expected first, got %q, %v", line, err)
+	}
+
+	// the closed connection only fails a later write, then it's dialed again
+	accepted := make(chan string)
+	go func() {
+		line, err := readLine(ln)
+		if err != nil {
+			line = err.Error()
+		}
+		accepted <- line
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	failed := false
+	for time.Now().Before(deadline) {
+		if !f.emitMsg([]byte("again")) {
+			failed = true
+		} else if failed {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !failed {
+		t.Fatal("expected a write to the closed connection to fail")
+	}
+
+	select {
+	case line := <-accepted:
+		if line != "again\n" {
+			t.Errorf("expected again, got %q", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the forwarder to dial again")
+	}
+}
+
+func TestTCPDropsWithoutServer(t *testing.T) {
+	f := newTestTCP(t, map[string]interface{}{"port": "1"})
+	if f.confErr == nil {
+		t.Fatal("expected a missing server to disable the forwarder")
+	}
+}
@@ -1,21 +1,58 @@
 package forwarder
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"net"
+	"sync/atomic"
+	"time"
 
 	l "github.com/Sirupsen/logrus"
+	"github.com/tsheasha/relayd/config"
+	"github.com/tsheasha/relayd/udpbatch"
+)
+
+// Defaults of the UDP forwarder coalescing
+const (
+	// DefaultUDPPacketSize keeps a datagram within a 1500 bytes
+	// ethernet MTU, IPv6 and UDP headers included
+	DefaultUDPPacketSize   = 1432
+	DefaultUDPBatchTimeout = 50
+
+	// largest payload of an IPv4 UDP datagram
+	maxUDPPayload = 65507
 )
 
 func init() {
 	RegisterForwarder("UDP", newUDP)
 }
 
-// UDP forwarder
+// UDP forwarder, sends a datagram per message or, with coalesce set,
+// packs messages separated by delimiter into datagrams of up to
+// packet_size bytes, flushed when full or after batch_timeout.
+// With batch_n set datagrams are queued and sent batch_n at a time
+// with a single system call where the platform supports it.
 type UDP struct {
 	BaseForwarder
 	conn   *net.UDPConn
 	server string
 	port   string
+
+	coalesce     bool
+	packetSize   int
+	delimiter    []byte
+	batchTimeout time.Duration
+
+	batchSize int
+	batchConn udpbatch.Conn
+
+	// nil when every message is sent as it comes
+	batcher *batcher
+
+	packetsSent   uint64
+	packetsFailed uint64
+	msgsFailed    uint64
 }
 
 // newUDP returns a new UDP forwarder
@@ -28,49 +65,246 @@ func newUDP(
 
 	u.maxBufferSize = initialBufferSize
 	u.log = log
+
+	u.packetSize = DefaultUDPPacketSize
+	u.delimiter = newline
+	u.batchTimeout = DefaultUDPBatchTimeout * time.Millisecond
+	u.batchSize = 1
 	return u
 }
 
 // Configure the UDP forwader
 func (u *UDP) Configure(configMap map[string]interface{}) {
 	if server, exists := configMap["server"]; exists {
-		u.server = server.(string)
+		u.server = fmt.Sprint(server)
 	} else {
 		u.log.Error("There was no server specified, there won't be any emissions")
+		u.confErr = errors.New("no server specified")
 	}
 
 	if port, exists := configMap["port"]; exists {
-		u.port = port.(string)
+		u.port = fmt.Sprint(port)
 	} else {
 		u.log.Error("There was no port specified , there won't be any emissions")
+		u.confErr = errors.New("no port specified")
 	}
+
+	if v, exists := configMap["coalesce"]; exists {
+		u.coalesce = config.GetAsBool(v, false)
+	}
+
+	if v, exists := configMap["packet_size"]; exists {
+		u.packetSize = config.GetAsInt(v, DefaultUDPPacketSize)
+		if u.packetSize <= 0 || u.packetSize > maxUDPPayload {
+			u.log.Error("Invalid packet_size ", v, ", falling back to ", DefaultUDPPacketSize)
+			u.packetSize = DefaultUDPPacketSize
+		}
+	}
+
+	if v, exists := configMap["delimiter"]; exists {
+		u.delimiter = []byte(fmt.Sprint(v))
+	}
+
+	if v, exists := configMap["batch_n"]; exists {
+		u.batchSize = config.GetAsInt(v, 1)
+		if u.batchSize < 1 {
+			u.log.Error("Invalid batch_n ", v, ", falling back to 1")
+			u.batchSize = 1
+		}
+	}
+
+	if v, exists := configMap["batch_timeout"]; exists {
+		if ms := config.GetAsInt(v, DefaultUDPBatchTimeout); ms > 0 {
+			u.batchTimeout = time.Duration(ms) * time.Millisecond
+		} else {
+			u.log.Error("Invalid batch_timeout ", v, ", falling back to ", DefaultUDPBatchTimeout)
+		}
+	}
+
 	u.configureCommonParams(configMap)
 }
 
-// Run runs the forwarder main loop
+// Run runs the forwarder main loop, every message is dropped if the
+// server can't be resolved
 func (u *UDP) Run() {
-	addr, err := net.ResolveUDPAddr("udp", u.server+":"+u.port)
+	if u.confErr == nil {
+		u.confErr = u.connect()
+	}
+	u.batcher = u.newBatcher()
+	if u.batcher != nil {
+		u.batcher.start()
+		u.batched = true
+	}
+	u.run(u.emitMsg)
+}
+
+// connect opens the socket to the server, batched when batch_n is set
+func (u *UDP) connect() error {
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(u.server, u.port))
 	if err != nil {
-		u.log.Error("Could not resolve remote UDP address")
-		return
+		u.log.Error("Could not resolve remote UDP address, there won't be any emissions: ", err)
+		return err
 	}
 
 	u.conn, err = net.DialUDP("udp", nil, addr)
 	if err != nil {
-		u.log.Error("Could not connect to remote UDP host")
-		return
+		u.countError(opDial, err)
+		u.log.Error("Could not connect to remote UDP host, there won't be any emissions: ", err)
+		return err
 	}
 
-	u.run(u.emitMsg)
+	if u.batchSize > 1 {
+		u.batchConn = udpbatch.New(u.conn)
+		if u.batchConn == nil {
+			u.log.Warn("Batched writes are not supported on this platform, sending a datagram at a time")
+		}
+	}
+	return nil
+}
+
+// newBatcher returns the batcher queuing messages until they fill
+// batch_n datagrams, or nil if they're sent one at a time
+func (u *UDP) newBatcher() *batcher {
+	datagrams := 1
+	if u.batchConn != nil {
+		datagrams = u.batchSize
+	}
+
+	if !u.coalesce {
+		if datagrams == 1 {
+			return nil
+		}
+		return newBatcher(datagrams, 0, u.batchTimeout, u.sendBatches)
+	}
+
+	// n messages take n delimiters less one in a datagram
+	b := newBatcher(0, datagrams*(u.packetSize+len(u.delimiter)), u.batchTimeout, u.sendBatches)
+	b.overhead = len(u.delimiter)
+	return b
+}
+
+// InternalMetrics : the base counters plus datagram counters,
+// msgsSent over packetsSent is the coalescing ratio
+func (u *UDP) InternalMetrics() InternalMetrics {
+	m := u.BaseForwarder.InternalMetrics()
+	m.Counters["packetsSent"] = float64(atomic.LoadUint64(&u.packetsSent))
+	m.Counters["packetsFailed"] = float64(atomic.LoadUint64(&u.packetsFailed))
+	m.Counters["msgsFailed"] = float64(atomic.LoadUint64(&u.msgsFailed))
+	return m
 }
 
+// emitMsg sends m or, when coalescing or batching, queues it. A queued
+// message is counted as sent once its datagram is, or in msgsFailed if
+// the datagram is lost.
 func (u *UDP) emitMsg(m []byte) bool {
+	if u.batcher == nil {
+		return u.send(m)
+	}
+
+	u.batcher.add(m, 1)
+	return true
+}
+
+func (u *UDP) sendBatches(batch [][]byte) {
+	if !u.coalesce {
+		datagrams := make([][][]byte, len(batch))
+		for i := range batch {
+			datagrams[i] = batch[i : i+1]
+		}
+		u.write(datagrams)
+		return
+	}
+
+	// pack the messages into datagrams of up to packet_size bytes
+	var datagrams [][][]byte
+	start := 0
+	for start < len(batch) {
+		size := len(batch[start])
+		end := start + 1
+		for end < len(batch) && size+len(u.delimiter)+len(batch[end]) <= u.packetSize {
+			size += len(u.delimiter) + len(batch[end])
+			end++
+		}
+		datagrams = append(datagrams, batch[start:end])
+		start = end
+	}
+	u.write(datagrams)
+}
+
+// write sends a datagram per group of messages, joined with delimiter,
+// batch_n at a time if the platform supports it
+func (u *UDP) write(datagrams [][][]byte) {
+	sent := func(msgs [][]byte) {
+		for _, msg := range msgs {
+			u.countSent(len(msg))
+		}
+	}
+
+	if u.batchConn == nil {
+		for _, msgs := range datagrams {
+			datagram := bytes.Join(msgs, u.delimiter)
+			began := time.Now()
+			delivered := u.send(datagram)
+			u.sendTime.Observe(time.Since(began))
+
+			if delivered {
+				sent(msgs)
+			} else {
+				atomic.AddUint64(&u.msgsFailed, uint64(len(msgs)))
+			}
+		}
+		return
+	}
+
+	batch := make([]udpbatch.Message, 0, u.batchSize)
+	for start := 0; start < len(datagrams); start += u.batchSize {
+		end := start + u.batchSize
+		if end > len(datagrams) {
+			end = len(datagrams)
+		}
+
+		batch = batch[:0]
+		for _, msgs := range datagrams[start:end] {
+			batch = append(batch, udpbatch.Message{Buffers: [][]byte{bytes.Join(msgs, u.delimiter)}})
+		}
+
+		began := time.Now()
+		written := 0
+		for written < len(batch) {
+			n, err := u.batchConn.WriteBatch(batch[written:], 0)
+			if err != nil || n == 0 {
+				if err != nil {
+					u.countError(opWrite, err)
+				}
+				u.log.Error("Failed to send messages to UDP endpoint: ", err)
+				break
+			}
+			written += n
+		}
+		u.sendTime.Observe(time.Since(began))
+
+		atomic.AddUint64(&u.packetsSent, uint64(written))
+		atomic.AddUint64(&u.packetsFailed, uint64(len(batch)-written))
+		for i, msgs := range datagrams[start:end] {
+			if i < written {
+				sent(msgs)
+			} else {
+				atomic.AddUint64(&u.msgsFailed, uint64(len(msgs)))
+			}
+		}
+	}
+}
 
-	_, err := u.conn.Write(m)
+// send writes a single datagram
+func (u *UDP) send(packet []byte) bool {
+	_, err := u.conn.Write(packet)
 	if err != nil {
+		u.countError(opWrite, err)
+		atomic.AddUint64(&u.packetsFailed, 1)
 		u.log.Error("Failed to send message to UDP endpoint")
 		return false
 	}
 
+	atomic.AddUint64(&u.packetsSent, 1)
 	return true
 }
@@ -0,0 +1,113 @@
+package forwarder
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+)
+
+func TestUDPPacksDatagrams(t *testing.T) {
+	for _, batchSize := range []int{1, 2} {
+		t.Run(fmt.Sprintf("batch_n=%d", batchSize), func(t *testing.T) {
+			server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer server.Close()
+
+			logger := l.New()
+			logger.Out = ioutil.Discard
+			u := newUDP(100, l.NewEntry(logger)).(*UDP)
+			u.Configure(map[string]interface{}{
+				"server":      "127.0.0.1",
+				"port":        server.LocalAddr().(*net.UDPAddr).Port,
+				"coalesce":    true,
+				"packet_size": 10,
+				"batch_n":     batchSize,
+			})
+			if err := u.connect(); err != nil {
+				t.Fatal(err)
+			}
+			defer u.conn.Close()
+
+			u.sendBatches([][]byte{
+				[]byte("aaa"), []byte("bbb"), []byte("ccc"), []byte("dddddddddddd"), []byte("e"),
+			})
+
+			expected := []string{"aaa\nbbb", "ccc", "dddddddddddd", "e"}
+			buffer := make([]byte, 100)
+			server.SetReadDeadline(time.Now().Add(5 * time.Second))
+			for _, datagram := range expected {
+				n, err := server.Read(buffer)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(buffer[:n]) != datagram {
+					t.Errorf("expected %q, got %q", datagram, buffer[:n])
+				}
+			}
+
+			counters := u.InternalMetrics().Counters
+			if counters["msgsSent"] != 5 || counters["bytesSent"] != 22 || counters["packetsSent"] != 4 {
+				t.Errorf("expected 5 messages of 22 bytes sent in 4 datagrams, got %v", counters)
+			}
+		})
+	}
+}
+
+// BenchmarkUDPWrite compares writing a datagram per system call with
+// writing batches of them with sendmmsg, over loopback
+func BenchmarkUDPWrite(b *testing.B) {
+	for _, batchSize := range []int{1, 8, 32} {
+		b.Run(fmt.Sprintf("batch_n=%d", batchSize), func(b *testing.B) {
+			server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				b.Fatal(err)
+			}
+			// nothing reads, what doesn't fit its buffer is dropped
+			defer server.Close()
+
+			u := newUDP(100, l.NewEntry(l.New())).(*UDP)
+			u.Configure(map[string]interface{}{
+				"server":  "127.0.0.1",
+				"port":    strconv.Itoa(server.LocalAddr().(*net.UDPAddr).Port),
+				"batch_n": batchSize,
+			})
+			if err := u.connect(); err != nil {
+				b.Fatal(err)
+			}
+			defer u.conn.Close()
+
+			// send the batches until the last one is flushed
+			u.batcher = u.newBatcher()
+			sent := make(chan bool)
+			if u.batcher != nil {
+				go func() {
+					for batch := range u.batcher.queue {
+						u.sendBatches(batch)
+					}
+					close(sent)
+				}()
+			}
+
+			payload := []byte("relayd.benchmark.datagram 1 1500000000")
+
+			b.ReportAllocs()
+			b.SetBytes(int64(len(payload)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				u.emitMsg(payload)
+			}
+			if u.batcher != nil {
+				u.batcher.flush()
+				close(u.batcher.queue)
+				<-sent
+			}
+		})
+	}
+}
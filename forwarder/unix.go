@@ -0,0 +1,104 @@
+package forwarder
+
+import (
+	"net"
+	"sync"
+
+	l "github.com/Sirupsen/logrus"
+)
+
+// socket types, set with the "type" key
+const (
+	unixStream   = "stream"
+	unixDatagram = "datagram"
+)
+
+func init() {
+	RegisterForwarder("Unix", newUnix)
+}
+
+// Unix forwarder, writes to a unix domain socket
+// either as a stream (SOCK_STREAM) or datagram (SOCK_DGRAM) socket
+type Unix struct {
+	BaseForwarder
+	conn       net.Conn
+	path       string
+	socketType string
+	framing    string
+
+	// keeps the frames of concurrent emissions from interleaving
+	writeLock sync.Mutex
+}
+
+// newUnix returns a new Unix forwarder
+func newUnix(
+	initialBufferSize int,
+	log *l.Entry) Forwarder {
+
+	u := new(Unix)
+	u.name = "Unix"
+
+	u.maxBufferSize = initialBufferSize
+	u.log = log
+	u.socketType = unixStream
+	return u
+}
+
+// Configure the Unix forwarder
+func (u *Unix) Configure(configMap map[string]interface{}) {
+	if path, exists := configMap["path"]; exists {
+		u.path = path.(string)
+	} else {
+		u.log.Error("There was no path specified, there won't be any emissions")
+	}
+
+	if socketType, exists := configMap["type"]; exists {
+		switch socketType {
+		case unixStream, unixDatagram:
+			u.socketType = socketType.(string)
+		default:
+			u.log.Error("Unknown socket type ", socketType, ", falling back to ", u.socketType)
+		}
+	}
+
+	u.framing = u.configureFraming(configMap)
+	u.configureCommonParams(configMap)
+}
+
+// Run runs the forwarder main loop
+func (u *Unix) Run() {
+	network := "unix"
+	if u.socketType == unixDatagram {
+		network = "unixgram"
+	}
+
+	var err error
+	u.conn, err = net.Dial(network, u.path)
+	if err != nil {
+		u.countError(opDial, err)
+		u.log.Error("Could not connect to unix socket ", u.path, ": ", err)
+		return
+	}
+
+	u.run(u.emitMsg)
+}
+
+func (u *Unix) emitMsg(m []byte) bool {
+	var err error
+	if u.socketType == unixDatagram {
+		// datagrams keep their boundaries, no framing needed
+		_, err = u.conn.Write(m)
+	} else {
+		u.writeLock.Lock()
+		err = writeFrame(u.conn, u.framing, m)
+		u.writeLock.Unlock()
+	}
+
+	if err != nil {
+		u.countError(opWrite, err)
+		u.log.Error("Failed to send message to unix socket")
+		return false
+	}
+
+	return true
+}
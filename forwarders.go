@@ -3,6 +3,8 @@ package main
 import (
 	"github.com/tsheasha/relayd/config"
 	"github.com/tsheasha/relayd/forwarder"
+	"github.com/tsheasha/relayd/internalserver"
+	"github.com/tsheasha/relayd/message"
 )
 
 func startForwarders(c config.Config) (forwarders []forwarder.Forwarder) {
@@ -26,6 +28,13 @@ func startForwarder(name string, globalConfig config.Config, instanceConfig map[
 	// now run a channel for each listener
 	f.InitListeners(globalConfig)
 
+	// and one for the internal metrics if they're reported through it
+	if name == internalserver.ReportForwarder(globalConfig) {
+		channels := f.ListenerChannels()
+		channels[internalserver.ReportSource] = make(chan *message.Message, f.MaxBufferSize())
+		f.SetListenerChannels(channels)
+	}
+
 	go f.Run()
 	return f
 }
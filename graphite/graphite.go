@@ -0,0 +1,57 @@
+// Package graphite parses and encodes the Graphite plaintext
+// and pickle protocols as spoken by carbon.
+package graphite
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"strconv"
+)
+
+// Metric is a single datapoint
+type Metric struct {
+	Path      string
+	Value     float64
+	Timestamp int64
+}
+
+// ParseLine parses a plaintext protocol line: "path value timestamp".
+// Like carbon, a timestamp of -1 stands for the time of reception and
+// is left for the caller to fill in.
+func ParseLine(line []byte) (Metric, error) {
+	fields := bytes.Fields(line)
+	if len(fields) != 3 {
+		return Metric{}, errors.New("graphite: expected path value timestamp")
+	}
+
+	value, err := parseValue(string(fields[1]))
+	if err != nil {
+		return Metric{}, err
+	}
+
+	timestamp, err := strconv.ParseFloat(string(fields[2]), 64)
+	if err != nil {
+		return Metric{}, errors.New("graphite: invalid timestamp " + string(fields[2]))
+	}
+
+	return Metric{Path: string(fields[0]), Value: value, Timestamp: int64(timestamp)}, nil
+}
+
+// parseValue parses a datapoint value, carbon drops NaN and infinities
+func parseValue(s string) (float64, error) {
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, errors.New("graphite: invalid value " + s)
+	}
+	return value, nil
+}
+
+// AppendLine appends m as a plaintext protocol line, without newline
+func (m Metric) AppendLine(dst []byte) []byte {
+	dst = append(dst, m.Path...)
+	dst = append(dst, ' ')
+	dst = strconv.AppendFloat(dst, m.Value, 'f', -1, 64)
+	dst = append(dst, ' ')
+	return strconv.AppendInt(dst, m.Timestamp, 10)
+}
@@ -0,0 +1,473 @@
+package graphite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Pickle opcodes, only the ones needed to load lists of tuples of
+// strings and numbers are supported. Anything that would import or
+// call Python code (GLOBAL, REDUCE, ...) is rejected.
+const (
+	opMark           = '('
+	opStop           = '.'
+	opPop            = '0'
+	opNone           = 'N'
+	opInt            = 'I'
+	opBinInt         = 'J'
+	opBinInt1        = 'K'
+	opBinInt2        = 'M'
+	opLong           = 'L'
+	opFloat          = 'F'
+	opBinFloat       = 'G'
+	opString         = 'S'
+	opBinString      = 'T'
+	opShortBinString = 'U'
+	opUnicode        = 'V'
+	opBinUnicode     = 'X'
+	opEmptyList      = ']'
+	opList           = 'l'
+	opAppend         = 'a'
+	opAppends        = 'e'
+	opEmptyTuple     = ')'
+	opTuple          = 't'
+	opPut            = 'p'
+	opBinPut         = 'q'
+	opLongBinPut     = 'r'
+	opGet            = 'g'
+	opBinGet         = 'h'
+	opLongBinGet     = 'j'
+	opProto          = 0x80
+	opTuple1         = 0x85
+	opTuple2         = 0x86
+	opTuple3         = 0x87
+	opNewTrue        = 0x88
+	opNewFalse       = 0x89
+	opLong1          = 0x8a
+	opShortBinUni    = 0x8c
+	opBinUnicode8    = 0x8d
+	opMemoize        = 0x94
+	opFrame          = 0x95
+)
+
+// pickleList is a Python list, a pointer so that appending
+// to it is seen through the memo too
+type pickleList struct {
+	items []interface{}
+}
+
+// mark separates the stack from the items pushed after a MARK
+type mark struct{}
+
+// DecodePickle decodes a pickle protocol payload, a list of
+// (path, (timestamp, value)) tuples. Malformed datapoints are
+// skipped and counted in invalid.
+func DecodePickle(b []byte) (metrics []Metric, invalid int, err error) {
+	obj, err := unpickle(b)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	list, ok := obj.(*pickleList)
+	if !ok {
+		return nil, 0, errors.New("graphite: pickle is not a list")
+	}
+
+	for _, item := range list.items {
+		m, ok := toMetric(item)
+		if !ok {
+			invalid++
+			continue
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics, invalid, nil
+}
+
+func toMetric(item interface{}) (Metric, bool) {
+	outer, ok := item.([]interface{})
+	if !ok || len(outer) != 2 {
+		return Metric{}, false
+	}
+
+	path, ok := outer[0].(string)
+	if !ok || path == "" {
+		return Metric{}, false
+	}
+
+	datapoint, ok := outer[1].([]interface{})
+	if !ok || len(datapoint) != 2 {
+		return Metric{}, false
+	}
+
+	timestamp, ok := toFloat(datapoint[0])
+	if !ok {
+		return Metric{}, false
+	}
+
+	value, ok := toFloat(datapoint[1])
+	if !ok || math.IsNaN(value) || math.IsInf(value, 0) {
+		return Metric{}, false
+	}
+
+	return Metric{Path: path, Value: value, Timestamp: int64(timestamp)}, true
+}
+
+// toFloat converts like carbon's float(), numbers and numeric strings
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// unpickle runs the subset of the pickle machine described above
+func unpickle(b []byte) (interface{}, error) {
+	r := &pickleReader{b: b}
+	var stack []interface{}
+	memo := make(map[int]interface{})
+
+	pop := func() (interface{}, error) {
+		if len(stack) == 0 {
+			return nil, errors.New("graphite: pickle stack underflow")
+		}
+		v := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		return v, nil
+	}
+
+	// popMark returns the items pushed since the last MARK
+	popMark := func() ([]interface{}, error) {
+		for i := len(stack) - 1; i >= 0; i-- {
+			if _, ok := stack[i].(mark); ok {
+				items := append([]interface{}(nil), stack[i+1:]...)
+				stack = stack[:i]
+				return items, nil
+			}
+		}
+		return nil, errors.New("graphite: pickle mark not found")
+	}
+
+	for {
+		op, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+
+		switch op {
+		case opStop:
+			return pop()
+		case opProto:
+			_, err = r.next(1)
+		case opFrame:
+			_, err = r.next(8)
+		case opMark:
+			stack = append(stack, mark{})
+		case opPop:
+			_, err = pop()
+		case opNone:
+			stack = append(stack, nil)
+		case opNewTrue:
+			stack = append(stack, int64(1))
+		case opNewFalse:
+			stack = append(stack, int64(0))
+
+		case opInt, opLong:
+			var line []byte
+			if line, err = r.line(); err == nil {
+				var n int64
+				n, err = strconv.ParseInt(string(bytes.TrimSuffix(line, []byte("L"))), 10, 64)
+				stack = append(stack, n)
+			}
+		case opBinInt:
+			var v []byte
+			if v, err = r.next(4); err == nil {
+				stack = append(stack, int64(int32(binary.LittleEndian.Uint32(v))))
+			}
+		case opBinInt1:
+			var v []byte
+			if v, err = r.next(1); err == nil {
+				stack = append(stack, int64(v[0]))
+			}
+		case opBinInt2:
+			var v []byte
+			if v, err = r.next(2); err == nil {
+				stack = append(stack, int64(binary.LittleEndian.Uint16(v)))
+			}
+		case opLong1:
+			var n int64
+			if n, err = r.long1(); err == nil {
+				stack = append(stack, n)
+			}
+		case opFloat:
+			var line []byte
+			if line, err = r.line(); err == nil {
+				var f float64
+				f, err = strconv.ParseFloat(string(line), 64)
+				stack = append(stack, f)
+			}
+		case opBinFloat:
+			var v []byte
+			if v, err = r.next(8); err == nil {
+				stack = append(stack, math.Float64frombits(binary.BigEndian.Uint64(v)))
+			}
+
+		case opString:
+			var line []byte
+			if line, err = r.line(); err == nil {
+				var s string
+				s, err = unquote(line)
+				stack = append(stack, s)
+			}
+		case opUnicode:
+			var line []byte
+			if line, err = r.line(); err == nil {
+				stack = append(stack, string(line))
+			}
+		case opShortBinString, opShortBinUni:
+			var s string
+			if s, err = r.sized(1); err == nil {
+				stack = append(stack, s)
+			}
+		case opBinString, opBinUnicode:
+			var s string
+			if s, err = r.sized(4); err == nil {
+				stack = append(stack, s)
+			}
+		case opBinUnicode8:
+			var s string
+			if s, err = r.sized(8); err == nil {
+				stack = append(stack, s)
+			}
+
+		case opEmptyList:
+			stack = append(stack, &pickleList{})
+		case opList:
+			var items []interface{}
+			if items, err = popMark(); err == nil {
+				stack = append(stack, &pickleList{items: items})
+			}
+		case opAppend, opAppends:
+			var items []interface{}
+			if op == opAppend {
+				var item interface{}
+				item, err = pop()
+				items = []interface{}{item}
+			} else {
+				items, err = popMark()
+			}
+			if err == nil {
+				if len(stack) == 0 {
+					return nil, errors.New("graphite: pickle stack underflow")
+				}
+				list, ok := stack[len(stack)-1].(*pickleList)
+				if !ok {
+					return nil, errors.New("graphite: pickle append to a non list")
+				}
+				list.items = append(list.items, items...)
+			}
+
+		case opEmptyTuple:
+			stack = append(stack, []interface{}{})
+		case opTuple:
+			var items []interface{}
+			if items, err = popMark(); err == nil {
+				stack = append(stack, items)
+			}
+		case opTuple1, opTuple2, opTuple3:
+			n := int(op-opTuple1) + 1
+			if len(stack) < n {
+				return nil, errors.New("graphite: pickle stack underflow")
+			}
+			items := append([]interface{}(nil), stack[len(stack)-n:]...)
+			stack = append(stack[:len(stack)-n], items)
+
+		case opPut, opBinPut, opLongBinPut, opMemoize:
+			var index int
+			if index, err = r.memoIndex(op, len(memo)); err == nil {
+				if len(stack) == 0 {
+					return nil, errors.New("graphite: pickle stack underflow")
+				}
+				memo[index] = stack[len(stack)-1]
+			}
+		case opGet, opBinGet, opLongBinGet:
+			var index int
+			if index, err = r.memoIndex(op, 0); err == nil {
+				v, exists := memo[index]
+				if !exists {
+					return nil, fmt.Errorf("graphite: pickle memo %d not found", index)
+				}
+				stack = append(stack, v)
+			}
+
+		default:
+			return nil, fmt.Errorf("graphite: unsupported pickle opcode 0x%02x", op)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// pickleReader reads the arguments of the opcodes
+type pickleReader struct {
+	b []byte
+}
+
+var errPickleTruncated = errors.New("graphite: truncated pickle")
+
+func (r *pickleReader) byte() (byte, error) {
+	v, err := r.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return v[0], nil
+}
+
+func (r *pickleReader) next(n int) ([]byte, error) {
+	if n < 0 || n > len(r.b) {
+		return nil, errPickleTruncated
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v, nil
+}
+
+// line reads up to the next newline, for the text opcodes of protocol 0
+func (r *pickleReader) line() ([]byte, error) {
+	end := bytes.IndexByte(r.b, '\n')
+	if end < 0 {
+		return nil, errPickleTruncated
+	}
+	v := r.b[:end]
+	r.b = r.b[end+1:]
+	return v, nil
+}
+
+// sized reads a string prefixed by its little endian length of size bytes
+func (r *pickleReader) sized(size int) (string, error) {
+	prefix, err := r.next(size)
+	if err != nil {
+		return "", err
+	}
+
+	var n uint64
+	for i := size - 1; i >= 0; i-- {
+		n = n<<8 | uint64(prefix[i])
+	}
+	if n > uint64(len(r.b)) {
+		return "", errPickleTruncated
+	}
+
+	v, err := r.next(int(n))
+	return string(v), err
+}
+
+// long1 reads a little endian two's complement integer of up to 8 bytes
+func (r *pickleReader) long1() (int64, error) {
+	size, err := r.byte()
+	if err != nil {
+		return 0, err
+	}
+	if size > 8 {
+		return 0, errors.New("graphite: pickle long out of range")
+	}
+
+	v, err := r.next(int(size))
+	if err != nil || size == 0 {
+		return 0, err
+	}
+
+	var n uint64
+	for i := len(v) - 1; i >= 0; i-- {
+		n = n<<8 | uint64(v[i])
+	}
+	// sign extend
+	shift := 64 - 8*uint(size)
+	return int64(n<<shift) >> shift, nil
+}
+
+// memoIndex reads the memo index argument of op, MEMOIZE uses the next free one
+func (r *pickleReader) memoIndex(op byte, next int) (int, error) {
+	switch op {
+	case opMemoize:
+		return next, nil
+	case opPut, opGet:
+		line, err := r.line()
+		if err != nil {
+			return 0, err
+		}
+		return strconv.Atoi(string(line))
+	case opBinPut, opBinGet:
+		v, err := r.next(1)
+		if err != nil {
+			return 0, err
+		}
+		return int(v[0]), nil
+	}
+
+	v, err := r.next(4)
+	if err != nil {
+		return 0, err
+	}
+	return int(binary.LittleEndian.Uint32(v)), nil
+}
+
+// unquote decodes the repr() of a string, as written by the STRING opcode
+func unquote(line []byte) (string, error) {
+	if len(line) < 2 || line[0] != line[len(line)-1] || (line[0] != '\'' && line[0] != '"') {
+		return "", errors.New("graphite: invalid pickle string")
+	}
+
+	inner := string(line[1 : len(line)-1])
+	if line[0] == '\'' {
+		inner = string(bytes.Replace(bytes.Replace([]byte(inner), []byte(`\'`), []byte(`'`), -1), []byte(`"`), []byte(`\"`), -1))
+	}
+	return strconv.Unquote(`"` + inner + `"`)
+}
+
+// AppendPickle appends metrics as a protocol 2 pickle of a list of
+// (path, (timestamp, value)) tuples, the payload carbon's pickle receiver
+// expects after the length prefix
+func AppendPickle(dst []byte, metrics []Metric) []byte {
+	var scratch [8]byte
+
+	dst = append(dst, opProto, 2, opEmptyList)
+	if len(metrics) > 0 {
+		dst = append(dst, opMark)
+		for _, m := range metrics {
+			binary.LittleEndian.PutUint32(scratch[:4], uint32(len(m.Path)))
+			dst = append(dst, opBinUnicode)
+			dst = append(dst, scratch[:4]...)
+			dst = append(dst, m.Path...)
+
+			if m.Timestamp >= math.MinInt32 && m.Timestamp <= math.MaxInt32 {
+				binary.LittleEndian.PutUint32(scratch[:4], uint32(int32(m.Timestamp)))
+				dst = append(dst, opBinInt)
+				dst = append(dst, scratch[:4]...)
+			} else {
+				binary.LittleEndian.PutUint64(scratch[:], uint64(m.Timestamp))
+				dst = append(dst, opLong1, 8)
+				dst = append(dst, scratch[:]...)
+			}
+
+			binary.BigEndian.PutUint64(scratch[:], math.Float64bits(m.Value))
+			dst = append(dst, opBinFloat)
+			dst = append(dst, scratch[:]...)
+			dst = append(dst, opTuple2, opTuple2)
+		}
+		dst = append(dst, opAppends)
+	}
+	return append(dst, opStop)
+}
@@ -0,0 +1,158 @@
+package graphite
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"testing"
+)
+
+var pickleMetrics = []Metric{
+	{Path: "servers.web1.load", Value: 1.5, Timestamp: 1500000000},
+	{Path: "servers.web1.cpu", Value: -0.25, Timestamp: 0},
+	{Path: "far.future", Value: 3, Timestamp: math.MaxInt32 + 1},
+	{Path: "far.past", Value: 1e300, Timestamp: math.MinInt32 - 1},
+	{Path: "unicode.ünïcode", Value: 0, Timestamp: -1},
+}
+
+func TestPickleRoundTrip(t *testing.T) {
+	for n := 0; n <= len(pickleMetrics); n++ {
+		metrics, invalid, err := DecodePickle(AppendPickle(nil, pickleMetrics[:n]))
+		if err != nil {
+			t.Fatalf("%d metrics: %s", n, err)
+		}
+		if invalid != 0 {
+			t.Errorf("%d metrics: %d invalid", n, invalid)
+		}
+		if n == 0 && len(metrics) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(metrics, pickleMetrics[:n]) {
+			t.Errorf("expected %v, got %v", pickleMetrics[:n], metrics)
+		}
+	}
+}
+
+func TestPickleAppendsToDst(t *testing.T) {
+	prefix := []byte("prefix")
+	payload := AppendPickle(append([]byte(nil), prefix...), pickleMetrics[:1])
+	if !bytes.HasPrefix(payload, prefix) {
+		t.Fatal("expected the pickle to be appended after dst")
+	}
+	if _, _, err := DecodePickle(payload[len(prefix):]); err != nil {
+		t.Error(err)
+	}
+}
+
+// what Python's pickle.dumps([("a.b", (1500000000, 1.5))], protocol) writes,
+// plus numbers as strings that carbon converts too
+func TestDecodePickleProtocols(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+	}{
+		{"protocol 0", "(lp0\n(S'a.b'\np1\n(I1500000000\nF1.5\ntp2\ntp3\na."},
+		{"protocol 0 unicode", "(lp0\n(Va.b\np1\n(L1500000000L\nF1.5\ntp2\ntp3\na."},
+		{"protocol 2", "\x80\x02]q\x00X\x03\x00\x00\x00a.bq\x01J\x00\x2f\x68\x59G?\xf8\x00\x00\x00\x00\x00\x00\x86q\x02\x86q\x03a."},
+		{"protocol 2 long", "\x80\x02]q\x00U\x03a.bq\x01\x8a\x04\x00\x2f\x68\x59G?\xf8\x00\x00\x00\x00\x00\x00\x86q\x02\x86q\x03a."},
+		{"protocol 4", "\x80\x04\x95\x23\x00\x00\x00\x00\x00\x00\x00]\x94\x8c\x03a.b\x94J\x00\x2f\x68\x59G?\xf8\x00\x00\x00\x00\x00\x00\x86\x94\x86\x94a."},
+		{"memo get", "\x80\x02]q\x00(U\x03a.bq\x01J\x00\x2f\x68\x59G?\xf8\x00\x00\x00\x00\x00\x00\x86\x86h\x00\x30e."},
+		{"strings", "(lp0\n(S'a.b'\n(S'1500000000'\nS'1.5'\ntta."},
+	}
+
+	expected := []Metric{{Path: "a.b", Value: 1.5, Timestamp: 1500000000}}
+	for _, test := range tests {
+		metrics, invalid, err := DecodePickle([]byte(test.payload))
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if invalid != 0 || !reflect.DeepEqual(metrics, expected) {
+			t.Errorf("%s: expected %v, got %v and %d invalid", test.name, expected, metrics, invalid)
+		}
+	}
+}
+
+func TestDecodePickleInvalidDatapoints(t *testing.T) {
+	// a valid datapoint between ones with a NaN value, an empty path,
+	// a value that isn't a number and a datapoint that isn't a pair
+	payload := "(lp0\n" +
+		"(S'nan'\n(I1\nFnan\ntta" +
+		"(S''\n(I1\nI2\ntta" +
+		"(S'ok'\n(I1\nI2\ntta" +
+		"(S'str'\n(I1\nS'x'\ntta" +
+		"(S'single'\n(I1\nttaI3\na."
+
+	metrics, invalid, err := DecodePickle([]byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if invalid != 5 {
+		t.Errorf("expected 5 invalid datapoints, got %d", invalid)
+	}
+	if expected := []Metric{{Path: "ok", Value: 2, Timestamp: 1}}; !reflect.DeepEqual(metrics, expected) {
+		t.Errorf("expected %v, got %v", expected, metrics)
+	}
+}
+
+func TestDecodePickleMalformed(t *testing.T) {
+	for _, payload := range []string{
+		"",
+		".",
+		"K\x01.",
+		"t.",
+		"a.",
+		"K\x01K\x02a.",
+		"]0a.",
+		"\x86.",
+		"h\x05.",
+		"j\x00\x00\x00\x01.",
+		"p1\n.",
+		"gx\n.",
+		"\x8a\x09\x00\x00\x00\x00\x00\x00\x00\x00\x00.",
+		"X\xff\xff\xff\xff.",
+		"\x8d\xff\xff\xff\xff\xff\xff\xff\xff.",
+		"S'unterminated\n.",
+		"Sno quotes\n.",
+		"Ix\n.",
+		"Fx\n.",
+		"c__builtin__\neval\n.",
+		"(S'x'\ntR.",
+		"]K\x01",
+	} {
+		if metrics, _, err := DecodePickle([]byte(payload)); err == nil {
+			t.Errorf("%q: expected an error, got %v", payload, metrics)
+		}
+	}
+}
+
+func TestDecodePickleTruncated(t *testing.T) {
+	payload := AppendPickle(nil, pickleMetrics)
+	for n := 0; n < len(payload); n++ {
+		if _, _, err := DecodePickle(payload[:n]); err == nil {
+			t.Errorf("expected the pickle truncated to %d of %d bytes to fail", n, len(payload))
+		}
+	}
+}
+
+func FuzzDecodePickle(f *testing.F) {
+	f.Add(AppendPickle(nil, pickleMetrics))
+	f.Add([]byte("(lp0\n(S'a.b'\np1\n(I1500000000\nF1.5\ntp2\ntp3\na."))
+	f.Add([]byte("\x80\x04\x95\x23\x00\x00\x00\x00\x00\x00\x00]\x94\x8c\x03a.b\x94J\x00\x2f\x68\x59G?\xf8\x00\x00\x00\x00\x00\x00\x86\x94\x86\x94a."))
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		metrics, _, err := DecodePickle(payload)
+		if err != nil {
+			return
+		}
+
+		// whatever was decoded survives being encoded again
+		again, invalid, err := DecodePickle(AppendPickle(nil, metrics))
+		if err != nil || invalid != 0 {
+			t.Fatalf("re-encoding %v: %v, %d invalid", metrics, err, invalid)
+		}
+		if len(again) != len(metrics) || (len(metrics) > 0 && !reflect.DeepEqual(again, metrics)) {
+			t.Fatalf("expected %v, got %v", metrics, again)
+		}
+	})
+}
@@ -0,0 +1,116 @@
+// Package histogram records latency distributions in fixed buckets,
+// cheap enough to be updated for every relayed message.
+package histogram
+
+import (
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Bounds are the upper bounds, in seconds, of the buckets
+// every histogram has, besides the +Inf one. It's an array so
+// that the buckets of a Histogram are sized after it.
+var Bounds = [...]float64{
+	0.0001, 0.00025, 0.0005,
+	0.001, 0.0025, 0.005,
+	0.01, 0.025, 0.05,
+	0.1, 0.25, 0.5,
+	1, 2.5, 5,
+	10, 30, 60,
+}
+
+// Quantiles reported in snapshots, by name
+var Quantiles = map[string]float64{
+	"p50":  0.5,
+	"p90":  0.9,
+	"p99":  0.99,
+	"p999": 0.999,
+}
+
+// Histogram counts observed durations, safe for concurrent use
+type Histogram struct {
+	// counts per bucket, the last one is +Inf
+	counts [len(Bounds) + 1]uint64
+	sumNs  uint64
+}
+
+// Observe records a duration, negative ones count as 0
+func (h *Histogram) Observe(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+
+	i := sort.SearchFloat64s(Bounds[:], d.Seconds())
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.sumNs, uint64(d))
+}
+
+// Snapshot is the state of a histogram at some point, in seconds
+type Snapshot struct {
+	Count     uint64
+	Sum       float64
+	Quantiles map[string]float64
+
+	// Buckets holds cumulative counts, the last one is +Inf which
+	// JSON can't represent, only exposition formats that can use them
+	Buckets []Bucket `json:"-"`
+}
+
+// Bucket is the number of observations up to UpperBound
+type Bucket struct {
+	UpperBound float64
+	Count      uint64
+}
+
+// Snapshot returns the current counts and the estimated quantiles
+func (h *Histogram) Snapshot() Snapshot {
+	s := Snapshot{
+		Sum:       time.Duration(atomic.LoadUint64(&h.sumNs)).Seconds(),
+		Quantiles: make(map[string]float64, len(Quantiles)),
+		Buckets:   make([]Bucket, len(h.counts)),
+	}
+
+	for i := range h.counts {
+		s.Count += atomic.LoadUint64(&h.counts[i])
+		s.Buckets[i].Count = s.Count
+		if i < len(Bounds) {
+			s.Buckets[i].UpperBound = Bounds[i]
+		} else {
+			s.Buckets[i].UpperBound = math.Inf(1)
+		}
+	}
+
+	for name, q := range Quantiles {
+		s.Quantiles[name] = s.quantile(q)
+	}
+	return s
+}
+
+// quantile estimates the q-quantile by interpolating linearly within
+// the bucket it falls in, like Prometheus' histogram_quantile
+func (s Snapshot) quantile(q float64) float64 {
+	if s.Count == 0 {
+		return 0
+	}
+
+	rank := q * float64(s.Count)
+	i := sort.Search(len(s.Buckets), func(i int) bool {
+		return float64(s.Buckets[i].Count) >= rank
+	})
+	if i >= len(Bounds) {
+		// in +Inf, the best guess is the largest finite bound
+		return Bounds[len(Bounds)-1]
+	}
+
+	lower, below := 0.0, uint64(0)
+	if i > 0 {
+		lower, below = Bounds[i-1], s.Buckets[i-1].Count
+	}
+	inBucket := s.Buckets[i].Count - below
+	if inBucket == 0 {
+		return Bounds[i]
+	}
+	return lower + (Bounds[i]-lower)*(rank-float64(below))/float64(inBucket)
+}
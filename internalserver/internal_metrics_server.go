@@ -7,53 +7,79 @@ import (
 	"net"
 	"net/http"
 	"runtime"
+	"time"
 
 	l "github.com/Sirupsen/logrus"
 	"github.com/tsheasha/relayd/config"
 	"github.com/tsheasha/relayd/forwarder"
+	"github.com/tsheasha/relayd/listener"
 )
 
 const (
-	defaultPort        = 19090
-	defaultMetricsPath = "/metrics"
+	defaultPort           = 19090
+	defaultMetricsPath    = "/metrics"
+	defaultPrometheusPath = "/metrics/prometheus"
+	prometheusContentType = "text/plain; version=0.0.4"
 )
 
-// InternalServer will collect from each forwarder the status and return it over HTTP
+// InternalServer will collect from each listener and forwarder the status and return it over HTTP
 type InternalServer struct {
 	log        *l.Entry
+	listeners  *[]listener.Listener
 	forwarders *[]forwarder.Forwarder
 	port       int
 	path       string
+
+	// the same metrics in the Prometheus text format
+	prometheusPath string
+
+	// reporting through a forwarder, see configureReport
+	reportForwarder string
+	reportFormat    string
+	reportInterval  time.Duration
+	reportPrefix    string
+	host            string
+	instance        string
 }
 
 // ResponseFormat is the structure of the response from an http request
 type ResponseFormat struct {
 	Memory     forwarder.InternalMetrics
-	forwarders map[string]forwarder.InternalMetrics
+	Listeners  map[string]listener.InternalMetrics
+	Forwarders map[string]forwarder.InternalMetrics
 }
 
 // New createse a new internal server instance
-func New(cfg config.Config, forwarders *[]forwarder.Forwarder) *InternalServer {
+func New(cfg config.Config, listeners *[]listener.Listener, forwarders *[]forwarder.Forwarder) *InternalServer {
 	srv := new(InternalServer)
 	srv.log = l.WithFields(l.Fields{"app": "relayd", "pkg": "internalserver"})
+	srv.listeners = listeners
 	srv.forwarders = forwarders
 	srv.configure(cfg.InternalServerConfig)
 	return srv
 }
 
-// Run starts a server on the specified port listening for the provided path
+// Run starts a server on the specified port listening for the provided path.
+// Reporting through a forwarder doesn't depend on the server, it goes on
+// if the port can't be bound.
 func (srv *InternalServer) Run() {
+	if srv.reportForwarder != "" {
+		go srv.report()
+	}
+
 	srv.log.Info(fmt.Sprintf("Starting to run internal metrics server on port %d on path %s", srv.port, srv.path))
 	http.HandleFunc(srv.path, srv.handleInternalMetricsRequest)
+	http.HandleFunc(srv.prometheusPath, srv.handlePrometheusRequest)
 
 	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", srv.port))
 	if err != nil {
 		srv.log.Error("Failed to start internal server: ", err)
+		return
 	}
 
 	srv.port = ln.Addr().(*net.TCPAddr).Port // reset the port with the bind port number (would change if port 0 is used)
 
-	if http.Serve(ln, nil) != nil {
+	if err := http.Serve(ln, nil); err != nil {
 		srv.log.Error("Failed to start internal server: ", err)
 	}
 }
@@ -71,31 +97,53 @@ func (srv *InternalServer) configure(cfgMap map[string]interface{}) {
 	} else {
 		srv.path = defaultMetricsPath
 	}
+
+	if val, exists := (cfgMap)["prometheusPath"]; exists {
+		srv.prometheusPath = val.(string)
+	} else {
+		srv.prometheusPath = defaultPrometheusPath
+	}
+
+	srv.configureReport(cfgMap)
 }
 
 // this is what services the request. The response will be JSON formatted like this:
-// 	{
-// 		"memory": {
-// 			"counters": {
+//
+//	{
+//		"Memory": {
+//			"Counters": {
 //				"TotalAlloc": 43.2,
-//				"NumGoRoutine": 12.3
+//				"NumGoroutine": 12.3
 //			},
-//			"gauges": {
+//			"Gauges": {
 //				"Alloc": 23.4,
 //				"Sys": 12.43
 //			}
 //		},
-//		"forwarders": {
+//		"Listeners": {
+//			"somelistener": {
+//				"Counters": {
+//					"requests": 42,
+//				}
+//			}
+//		},
+//		"Forwarders": {
 //			"someforwarder": {
-//				"counters": {
+//				"Counters": {
 //					"totalEmissions": 12332,
+//				},
+//				"Histograms": {
+//					"queueTime": {
+//						"Count": 12332,
+//						"Sum": 1.52,
+//						"Quantiles": {"p50": 0.0001, "p99": 0.0042}
+//					}
 //				}
 //			}
 //		}
 //	}
-//
 func (srv InternalServer) handleInternalMetricsRequest(writer http.ResponseWriter, req *http.Request) {
-	srv.log.Debug("Starting to handle request for internal metrics, checking ", len(*srv.forwarders), " forwarders")
+	srv.log.Debug("Starting to handle request for internal metrics, checking ", len(*srv.listeners), " listeners and ", len(*srv.forwarders), " forwarders")
 
 	rspString := string(*srv.buildResponse())
 
@@ -103,25 +151,44 @@ func (srv InternalServer) handleInternalMetricsRequest(writer http.ResponseWrite
 	io.WriteString(writer, rspString)
 }
 
-// responsible for querying each forwarder and serializing the total response
+// serves the same response in the Prometheus text format
+func (srv InternalServer) handlePrometheusRequest(writer http.ResponseWriter, req *http.Request) {
+	writer.Header().Set("Content-Type", prometheusContentType)
+	writer.Write(prometheusResponse(srv.collect()))
+}
+
+// responsible for serializing the total response
 func (srv InternalServer) buildResponse() *[]byte {
+	rsp := srv.collect()
+
+	asString, err := json.Marshal(rsp)
+	if err != nil {
+		srv.log.Warn("Failed to marshal response ", rsp, " because of error ", err)
+	}
+
+	return &asString
+}
+
+// responsible for querying each listener and forwarder, reports call it
+// concurrently with Run so it mustn't copy the server
+func (srv *InternalServer) collect() ResponseFormat {
 	memoryStats := getMemoryStats()
 
+	listenerStats := make(map[string]listener.InternalMetrics)
+	for _, inst := range *srv.listeners {
+		listenerStats[inst.Name()] = inst.InternalMetrics()
+	}
+
 	forwarderStats := make(map[string]forwarder.InternalMetrics)
 	for _, inst := range *srv.forwarders {
 		forwarderStats[inst.Name()] = inst.InternalMetrics()
 	}
 
 	rsp := ResponseFormat{}
-	rsp.forwarders = forwarderStats
+	rsp.Listeners = listenerStats
+	rsp.Forwarders = forwarderStats
 	rsp.Memory = *memoryStats
-
-	asString, err := json.Marshal(rsp)
-	if err != nil {
-		srv.log.Warn("Failed to marshal response ", rsp, " because of error ", err)
-	}
-
-	return &asString
+	return rsp
 }
 
 // gets the actual memory stats
@@ -0,0 +1,203 @@
+package internalserver
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/tsheasha/relayd/forwarder"
+	"github.com/tsheasha/relayd/histogram"
+)
+
+const prometheusPrefix = "relayd_"
+
+// keyLabels turns the parts of a key that name something other than the
+// value, e.g. the listener of queueLengthUDP or the window of
+// msgsSentRate10s, into labels. split gets the groups of the pattern and
+// returns the metric and its labels, as name and value pairs.
+var keyLabels = []struct {
+	pattern *regexp.Regexp
+	split   func(groups []string) (string, []string)
+}{
+	{
+		regexp.MustCompile(`^(queue(?:Length|Capacity|HighWater|Utilization))(.+)$`),
+		func(g []string) (string, []string) { return g[1], []string{"listener", g[2]} },
+	},
+	{
+		regexp.MustCompile(`^(.+Rate)(\d+[smh])$`),
+		func(g []string) (string, []string) { return g[1], []string{"window", g[2]} },
+	},
+	{
+		regexp.MustCompile(`^(.+Socket)(\d+)$`),
+		func(g []string) (string, []string) { return g[1], []string{"socket", g[2]} },
+	},
+	{
+		// processor0LineEndingsMsgsIn
+		regexp.MustCompile(`^processor(\d+)([A-Z][A-Za-z]*?)(Msgs(?:In|Modified|Dropped))$`),
+		func(g []string) (string, []string) {
+			return "processor" + g[3], []string{"stage", g[1], "type", snakeCase(g[2])}
+		},
+	},
+}
+
+// splitKey returns the metric a key is a value of and its labels
+func splitKey(key string) (string, []string) {
+	for _, k := range keyLabels {
+		if groups := k.pattern.FindStringSubmatch(key); groups != nil {
+			return k.split(groups)
+		}
+	}
+	return key, nil
+}
+
+// formatLabels renders name and value pairs as {name="value",...},
+// or nothing without any
+func formatLabels(pairs ...string) string {
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	parts := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, fmt.Sprintf("%s=%q", pairs[i], pairs[i+1]))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// family is a Prometheus metric family, its samples are complete lines
+type family struct {
+	kind    string
+	samples []string
+}
+
+// prometheusWriter collects the samples of every family so that each
+// family is written once with its TYPE line, as the text format requires
+type prometheusWriter map[string]*family
+
+func (w prometheusWriter) add(name, kind, labels string, value float64) {
+	f, exists := w[name]
+	if !exists {
+		f = &family{kind: kind}
+		w[name] = f
+	}
+	f.samples = append(f.samples, name+labels+" "+formatFloat(value))
+}
+
+func (w prometheusWriter) addMetrics(scope, label, instance string, counters, gauges map[string]float64) {
+	var scopeLabels []string
+	if label != "" {
+		scopeLabels = []string{label, instance}
+	}
+
+	add := func(key, suffix, kind string, value float64) {
+		metric, labels := splitKey(key)
+		labels = append(append([]string(nil), scopeLabels...), labels...)
+		w.add(prometheusPrefix+scope+"_"+snakeCase(metric)+suffix, kind, formatLabels(labels...), value)
+	}
+
+	for key, value := range counters {
+		add(key, "_total", "counter", value)
+	}
+	for key, value := range gauges {
+		add(key, "", "gauge", value)
+	}
+}
+
+func (w prometheusWriter) addHistogram(scope, label, instance, key string, s histogram.Snapshot) {
+	name := prometheusPrefix + scope + "_" + snakeCase(key) + "_seconds"
+	for _, b := range s.Buckets {
+		le := "+Inf"
+		if !math.IsInf(b.UpperBound, 1) {
+			le = formatFloat(b.UpperBound)
+		}
+		w.add(name+"_bucket", "", formatLabels(label, instance, "le", le), float64(b.Count))
+	}
+
+	labels := formatLabels(label, instance)
+	w.add(name+"_sum", "", labels, s.Sum)
+	w.add(name+"_count", "", labels, float64(s.Count))
+	if _, exists := w[name]; !exists {
+		w[name] = &family{kind: "histogram"}
+	}
+}
+
+// bytes renders the families sorted by name, so the TYPE line of a
+// histogram is followed by its bucket, count and sum series
+func (w prometheusWriter) bytes() []byte {
+	names := make([]string, 0, len(w))
+	for name := range w {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		f := w[name]
+		if f.kind != "" {
+			fmt.Fprintf(&buf, "# TYPE %s %s\n", name, f.kind)
+		}
+		for _, sample := range f.samples {
+			buf.WriteString(sample)
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Bytes()
+}
+
+// prometheusResponse renders a response in the Prometheus text format,
+// every counter and gauge key is converted to snake case and prefixed
+// with relayd_ and the kind of component it belongs to, which is named
+// by a label, as are the listener, window, socket or stage in the key
+func prometheusResponse(rsp ResponseFormat) []byte {
+	w := make(prometheusWriter)
+	w.addMetrics("memory", "", "", rsp.Memory.Counters, rsp.Memory.Gauges)
+
+	for name, m := range rsp.Listeners {
+		w.addMetrics("listener", "listener", name, m.Counters, m.Gauges)
+	}
+
+	for name, m := range rsp.Forwarders {
+		w.addForwarder(name, m)
+	}
+	return w.bytes()
+}
+
+func (w prometheusWriter) addForwarder(name string, m forwarder.InternalMetrics) {
+	w.addMetrics("forwarder", "forwarder", name, m.Counters, m.Gauges)
+	for key, s := range m.Histograms {
+		w.addHistogram("forwarder", "forwarder", name, key, s)
+	}
+}
+
+// snakeCase turns keys like msgsSent or HeapAlloc into msgs_sent and
+// heap_alloc, replacing anything a metric name can't hold with _
+func snakeCase(key string) string {
+	runes := []rune(key)
+	out := make([]rune, 0, len(runes)+4)
+	for i, r := range runes {
+		if unicode.IsUpper(r) && i > 0 {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				out = append(out, '_')
+			}
+		}
+
+		switch {
+		case r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+			out = append(out, unicode.ToLower(r))
+		default:
+			out = append(out, '_')
+		}
+	}
+	return string(out)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,246 @@
+package internalserver
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tsheasha/relayd/config"
+	"github.com/tsheasha/relayd/graphite"
+	"github.com/tsheasha/relayd/message"
+	"github.com/tsheasha/relayd/statsd"
+)
+
+// ReportSource is the listener name the forwarder reported through
+// sees the internal metrics coming from, e.g. to route on source
+const ReportSource = "InternalServer"
+
+const (
+	defaultReportFormat   = reportGraphite
+	defaultReportInterval = 10000
+	defaultReportPrefix   = "relayd"
+	defaultInstance       = "default"
+
+	// formats, set with the "reportFormat" key
+	reportGraphite = "graphite"
+	reportStatsD   = "statsd"
+	reportJSON     = "json"
+)
+
+// ReportForwarder is the name of the forwarder the internal metrics are
+// reported through, empty if they aren't. It needs a channel for them
+// before it starts running, named ReportSource.
+func ReportForwarder(cfg config.Config) string {
+	if val, exists := cfg.InternalServerConfig["reportForwarder"]; exists {
+		if name, ok := val.(string); ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// sample is a single value of the response, named after where it is in it
+type sample struct {
+	name    string
+	value   float64
+	counter bool
+}
+
+// jsonSample is a sample reported in the json format
+type jsonSample struct {
+	Name      string  `json:"name"`
+	Value     float64 `json:"value"`
+	Type      string  `json:"type"`
+	Host      string  `json:"host"`
+	Instance  string  `json:"instance"`
+	Timestamp int64   `json:"timestamp"`
+}
+
+func (srv *InternalServer) configureReport(cfgMap map[string]interface{}) {
+	if val, exists := cfgMap["reportForwarder"]; exists {
+		srv.reportForwarder, _ = val.(string)
+	}
+
+	srv.reportFormat = defaultReportFormat
+	if val, exists := cfgMap["reportFormat"]; exists {
+		switch val {
+		case reportGraphite, reportStatsD, reportJSON:
+			srv.reportFormat = val.(string)
+		default:
+			srv.log.Error("Unknown reportFormat ", val, ", falling back to ", srv.reportFormat)
+		}
+	}
+
+	ms := defaultReportInterval
+	if val, exists := cfgMap["reportInterval"]; exists {
+		ms = config.GetAsInt(val, defaultReportInterval)
+		if ms <= 0 {
+			srv.log.Error("Invalid reportInterval ", val, ", falling back to ", defaultReportInterval)
+			ms = defaultReportInterval
+		}
+	}
+	srv.reportInterval = time.Duration(ms) * time.Millisecond
+
+	srv.reportPrefix = defaultReportPrefix
+	if val, exists := cfgMap["reportPrefix"]; exists {
+		srv.reportPrefix = val.(string)
+	}
+
+	srv.instance = defaultInstance
+	if val, exists := cfgMap["instance"]; exists {
+		srv.instance = val.(string)
+	}
+
+	srv.host, _ = os.Hostname()
+	if srv.host == "" {
+		srv.host = "localhost"
+	}
+}
+
+// report sends the internal metrics through the report forwarder
+// every reportInterval, one message per value
+func (srv *InternalServer) report() {
+	var channel chan *message.Message
+	for _, inst := range *srv.forwarders {
+		if inst != nil && inst.Name() == srv.reportForwarder {
+			channel = inst.ListenerChannels()[ReportSource]
+		}
+	}
+	if channel == nil {
+		srv.log.Error("Cannot report internal metrics, there's no forwarder ", srv.reportForwarder)
+		return
+	}
+
+	srv.log.Info("Reporting internal metrics through ", srv.reportForwarder, " every ", srv.reportInterval)
+	ticker := time.NewTicker(srv.reportInterval)
+	defer ticker.Stop()
+
+	// StatsD counters are reported as the increase since the last report
+	previous := make(map[string]float64)
+
+	for now := range ticker.C {
+		for _, s := range samples(srv.collect()) {
+			line := srv.format(s, now, previous)
+			if line == nil {
+				continue
+			}
+
+			msg := message.New(line)
+			msg.Received = now
+			msg.Source = ReportSource
+			msg.Framing = message.FramingNewline
+			msg.SetAttribute("metric", s.name)
+			channel <- msg
+		}
+	}
+}
+
+// format renders s as a line in the report format, or nil
+// when there's nothing to report
+func (srv *InternalServer) format(s sample, now time.Time, previous map[string]float64) []byte {
+	switch srv.reportFormat {
+	case reportStatsD:
+		metric := &statsd.Metric{
+			Name: srv.reportPrefix + "." + s.name,
+			Type: statsd.Gauge,
+			Tags: "host:" + srv.host + ",instance:" + srv.instance,
+		}
+		if s.counter {
+			delta := s.value - previous[s.name]
+			previous[s.name] = s.value
+			if delta <= 0 {
+				return nil
+			}
+			metric.Type = statsd.Counter
+			metric.Samples = []statsd.Sample{{Value: statsdValue(delta), Rate: 1}}
+		} else if s.value < 0 {
+			// a leading sign would make it relative, so reset to 0 first
+			metric.Samples = []statsd.Sample{{Value: "0", Rate: 1}, {Value: statsdValue(s.value), Rate: 1}}
+		} else {
+			metric.Samples = []statsd.Sample{{Value: statsdValue(s.value), Rate: 1}}
+		}
+		return metric.Append(nil)
+
+	case reportJSON:
+		typ := "gauge"
+		if s.counter {
+			typ = "counter"
+		}
+		line, err := json.Marshal(jsonSample{
+			Name:      srv.reportPrefix + "." + s.name,
+			Value:     s.value,
+			Type:      typ,
+			Host:      srv.host,
+			Instance:  srv.instance,
+			Timestamp: now.Unix(),
+		})
+		if err != nil {
+			srv.log.Warn("Failed to marshal ", s.name, ": ", err)
+			return nil
+		}
+		return line
+
+	default:
+		// Graphite has no tags, the host and instance are part of the path
+		metric := graphite.Metric{
+			Path:      strings.Join([]string{srv.reportPrefix, pathComponent(srv.host), pathComponent(srv.instance), s.name}, "."),
+			Value:     s.value,
+			Timestamp: now.Unix(),
+		}
+		return metric.AppendLine(nil)
+	}
+}
+
+// samples flattens a response into values named like
+// forwarders.UDP.msgsSent or memory.HeapAlloc, sorted by name.
+// Histograms are reported as their count and quantiles.
+func samples(rsp ResponseFormat) []sample {
+	var all []sample
+	add := func(prefix string, counters, gauges map[string]float64) {
+		for key, value := range counters {
+			all = append(all, sample{name: prefix + pathComponent(key), value: value, counter: true})
+		}
+		for key, value := range gauges {
+			all = append(all, sample{name: prefix + pathComponent(key), value: value})
+		}
+	}
+
+	add("memory.", rsp.Memory.Counters, rsp.Memory.Gauges)
+	for name, m := range rsp.Listeners {
+		add("listeners."+pathComponent(name)+".", m.Counters, m.Gauges)
+	}
+	for name, m := range rsp.Forwarders {
+		prefix := "forwarders." + pathComponent(name) + "."
+		add(prefix, m.Counters, m.Gauges)
+		for key, s := range m.Histograms {
+			histogram := prefix + pathComponent(key) + "."
+			all = append(all, sample{name: histogram + "count", value: float64(s.Count), counter: true})
+			for q, value := range s.Quantiles {
+				all = append(all, sample{name: histogram + q, value: value})
+			}
+		}
+	}
+
+	sort.Slice(all, func(i, j int) bool { return all[i].name < all[j].name })
+	return all
+}
+
+// pathComponent keeps a name from adding levels to a metric path
+// or breaking the line it's in
+func pathComponent(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', ' ', ':', '|', '#', ',', '\n':
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// statsdValue formats v without exponent, which StatsD doesn't parse
+func statsdValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
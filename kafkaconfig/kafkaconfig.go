@@ -0,0 +1,155 @@
+// Package kafkaconfig holds the sarama client settings shared by
+// the Kafka listener and the Kafka forwarder.
+package kafkaconfig
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/tsheasha/relayd/config"
+)
+
+// Configure maps the client level options (client id, version, network
+// timeouts, TLS and SASL) of a listener or forwarder config onto conf
+func Configure(conf *sarama.Config, configMap map[string]interface{}) []string {
+	var errs []string
+
+	if err := configureNet(conf, configMap); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if err := configureTLS(conf, configMap); err != nil {
+		errs = append(errs, "tls: "+err.Error())
+	}
+
+	if err := configureSASL(conf, configMap); err != nil {
+		errs = append(errs, "sasl: "+err.Error())
+	}
+
+	return errs
+}
+
+// configureNet maps the client and connection options onto the sarama config
+func configureNet(conf *sarama.Config, configMap map[string]interface{}) error {
+	if v, exists := configMap["client_id"]; exists {
+		conf.ClientID = fmt.Sprint(v)
+	}
+
+	if v, exists := configMap["version"]; exists {
+		version, err := sarama.ParseKafkaVersion(fmt.Sprint(v))
+		if err != nil {
+			return fmt.Errorf("invalid version %v: %s", v, err)
+		}
+		conf.Version = version
+	}
+
+	durations := []struct {
+		key  string
+		dest *time.Duration
+	}{
+		{"dial_timeout", &conf.Net.DialTimeout},
+		{"read_timeout", &conf.Net.ReadTimeout},
+		{"write_timeout", &conf.Net.WriteTimeout},
+		{"keep_alive", &conf.Net.KeepAlive},
+	}
+	for _, opt := range durations {
+		if v, exists := configMap[opt.key]; exists {
+			n, err := ParseInt(opt.key, v, 0)
+			if err != nil {
+				return err
+			}
+			*opt.dest = time.Duration(n) * time.Millisecond
+		}
+	}
+
+	return nil
+}
+
+// configureTLS enables TLS towards the brokers if any tls_* key is set
+func configureTLS(conf *sarama.Config, configMap map[string]interface{}) error {
+	tlsConfig, err := config.GetTLSClientConfig(configMap)
+	if err != nil || tlsConfig == nil {
+		return err
+	}
+
+	conf.Net.TLS.Enable = true
+	conf.Net.TLS.Config = tlsConfig
+	return nil
+}
+
+// configureSASL enables SASL authentication if sasl_mechanism is set,
+// the password is read from sasl_password_file to keep it out of the config
+func configureSASL(conf *sarama.Config, configMap map[string]interface{}) error {
+	v, exists := configMap["sasl_mechanism"]
+	if !exists {
+		return nil
+	}
+
+	mechanism, _ := v.(string)
+	switch strings.ToUpper(mechanism) {
+	case sarama.SASLTypePlaintext:
+		conf.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+	case sarama.SASLTypeSCRAMSHA256:
+		conf.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
+		conf.Net.SASL.SCRAMClientGeneratorFunc = newSCRAMClientGenerator(sha256Generator)
+	case sarama.SASLTypeSCRAMSHA512:
+		conf.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
+		conf.Net.SASL.SCRAMClientGeneratorFunc = newSCRAMClientGenerator(sha512Generator)
+	default:
+		return fmt.Errorf("unsupported sasl_mechanism %v", v)
+	}
+
+	if v, exists := configMap["sasl_username"]; exists {
+		conf.Net.SASL.User, _ = v.(string)
+	}
+	if conf.Net.SASL.User == "" {
+		return fmt.Errorf("sasl_username is required for %s", conf.Net.SASL.Mechanism)
+	}
+
+	v, exists = configMap["sasl_password_file"]
+	if !exists {
+		return fmt.Errorf("sasl_password_file is required for %s", conf.Net.SASL.Mechanism)
+	}
+	passwordFile, _ := v.(string)
+	password, err := ioutil.ReadFile(passwordFile)
+	if err != nil {
+		return fmt.Errorf("cannot read sasl_password_file: %s", err)
+	}
+
+	conf.Net.SASL.Enable = true
+	conf.Net.SASL.Handshake = true
+	conf.Net.SASL.Password = strings.TrimRight(string(password), "\r\n")
+	return nil
+}
+
+// ParseInt accepts both JSON numbers and numeric strings, unlike
+// config.GetAsInt it refuses garbage instead of falling back to a default
+func ParseInt(key string, v interface{}, min int) (int, error) {
+	var n int
+	switch value := v.(type) {
+	case string:
+		parsed, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s %q, expected an integer", key, value)
+		}
+		n = parsed
+	case float64:
+		if value != float64(int(value)) {
+			return 0, fmt.Errorf("invalid %s %v, expected an integer", key, value)
+		}
+		n = int(value)
+	case int:
+		n = value
+	default:
+		return 0, fmt.Errorf("invalid %s %v, expected an integer", key, v)
+	}
+
+	if n < min {
+		return 0, fmt.Errorf("invalid %s %d, must be at least %d", key, n, min)
+	}
+	return n, nil
+}
@@ -0,0 +1,147 @@
+package kafkaconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// writeCert writes a self-signed certificate for localhost and its key
+// to dir, and returns the paths along with the certificate for servers
+func writeCert(t *testing.T, dir string) (certFile, keyFile string, cert tls.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err = tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, cert
+}
+
+// newTLSBroker starts a mock broker that only speaks TLS
+func newTLSBroker(t *testing.T, cert tls.Certificate) *sarama.MockBroker {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	broker := sarama.NewMockBrokerListener(t, 1, ln)
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()),
+	})
+	return broker
+}
+
+func TestConfigureTLSConnectsToBroker(t *testing.T) {
+	caFile, _, cert := writeCert(t, t.TempDir())
+	broker := newTLSBroker(t, cert)
+	defer broker.Close()
+
+	conf := sarama.NewConfig()
+	conf.Net.DialTimeout = 5 * time.Second
+	if errs := Configure(conf, map[string]interface{}{
+		"tls_ca_file":     caFile,
+		"tls_server_name": "localhost",
+	}); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	if !conf.Net.TLS.Enable {
+		t.Fatal("expected tls_ca_file to enable TLS")
+	}
+
+	client, err := sarama.NewClient([]string{broker.Addr()}, conf)
+	if err != nil {
+		t.Fatal("cannot connect to the TLS broker: ", err)
+	}
+	client.Close()
+}
+
+func TestConfigureTLSVerifiesBroker(t *testing.T) {
+	dir := t.TempDir()
+	_, _, cert := writeCert(t, dir)
+	otherCA, _, _ := writeCert(t, t.TempDir())
+	broker := newTLSBroker(t, cert)
+	defer broker.Close()
+
+	conf := sarama.NewConfig()
+	conf.Net.DialTimeout = 5 * time.Second
+	conf.Metadata.Retry.Max = 0
+	if errs := Configure(conf, map[string]interface{}{
+		"tls_ca_file":     otherCA,
+		"tls_server_name": "localhost",
+	}); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+
+	client, err := sarama.NewClient([]string{broker.Addr()}, conf)
+	if err == nil {
+		client.Close()
+		t.Fatal("expected a broker signed by another CA to be refused")
+	}
+}
+
+func TestConfigureTLSExplicitlyDisabled(t *testing.T) {
+	caFile, _, _ := writeCert(t, t.TempDir())
+
+	for _, value := range []interface{}{false, "false"} {
+		conf := sarama.NewConfig()
+		if errs := Configure(conf, map[string]interface{}{
+			"tls":         value,
+			"tls_ca_file": caFile,
+		}); len(errs) != 0 {
+			t.Fatal(errs)
+		}
+		if conf.Net.TLS.Enable {
+			t.Errorf("expected tls %#v to disable TLS despite tls_ca_file", value)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package kafkaconfig
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+
+	"github.com/Shopify/sarama"
+	"github.com/xdg-go/scram"
+)
+
+var (
+	sha256Generator scram.HashGeneratorFcn = sha256.New
+	sha512Generator scram.HashGeneratorFcn = sha512.New
+)
+
+// scramClient adapts xdg-go/scram to sarama.SCRAMClient
+type scramClient struct {
+	*scram.Client
+	*scram.ClientConversation
+	scram.HashGeneratorFcn
+}
+
+func newSCRAMClientGenerator(fcn scram.HashGeneratorFcn) func() sarama.SCRAMClient {
+	return func() sarama.SCRAMClient {
+		return &scramClient{HashGeneratorFcn: fcn}
+	}
+}
+
+// Begin prepares the conversation with the given credentials
+func (c *scramClient) Begin(userName, password, authzID string) (err error) {
+	c.Client, err = c.HashGeneratorFcn.NewClient(userName, password, authzID)
+	if err != nil {
+		return err
+	}
+	c.ClientConversation = c.Client.NewConversation()
+	return nil
+}
+
+// Step takes the server challenge and returns the client response
+func (c *scramClient) Step(challenge string) (string, error) {
+	return c.ClientConversation.Step(challenge)
+}
+
+// Done tells whether the SCRAM exchange has completed
+func (c *scramClient) Done() bool {
+	return c.ClientConversation.Done()
+}
@@ -0,0 +1,110 @@
+package listener
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Address families, set with the "family" key
+const (
+	familyDual = "dual"
+	familyIPv4 = "ipv4"
+	familyIPv6 = "ipv6"
+)
+
+// configureAddress reads where a socket listener binds:
+//
+//	bind       IPv4/IPv6 address or hostname, all interfaces by default
+//	interface  name of a network interface to take the address from
+//	family     ipv4 (default), ipv6 or dual, dual accepts both on unspecified
+//	           addresses. Without a family an IPv6 bind address implies ipv6.
+func (l *baseListener) configureAddress(configMap map[string]interface{}) {
+	if bind, exists := configMap["bind"]; exists {
+		l.bind = fmt.Sprint(bind)
+	}
+
+	if iface, exists := configMap["interface"]; exists {
+		l.iface = fmt.Sprint(iface)
+	}
+
+	l.family = familyIPv4
+	// the zone of a link-local address isn't part of it
+	host := strings.SplitN(l.bind, "%", 2)[0]
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		l.family = familyIPv6
+	}
+
+	if family, exists := configMap["family"]; exists {
+		switch name := fmt.Sprint(family); name {
+		case familyDual, familyIPv4, familyIPv6:
+			l.family = name
+		default:
+			l.log.Error("Unknown address family ", family, ", falling back to ", l.family)
+		}
+	}
+}
+
+// listenAddress returns the network ("tcp", "udp6"...) and address
+// to listen on for proto and port according to the configuration
+func (l *baseListener) listenAddress(proto, port string) (string, string, error) {
+	network := proto
+	switch l.family {
+	case familyIPv4:
+		network = proto + "4"
+	case familyIPv6:
+		network = proto + "6"
+	}
+
+	host := l.bind
+	if l.iface != "" {
+		if host != "" {
+			return "", "", fmt.Errorf("bind and interface are mutually exclusive")
+		}
+
+		var err error
+		if host, err = interfaceAddress(l.iface, l.family); err != nil {
+			return "", "", err
+		}
+	}
+
+	return network, net.JoinHostPort(host, port), nil
+}
+
+// interfaceAddress returns the first address of iface in family,
+// IPv4 is preferred for dual
+func interfaceAddress(name string, family string) (string, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return "", err
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", err
+	}
+
+	var ipv6 string
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+
+		if ipNet.IP.To4() != nil {
+			if family != familyIPv6 {
+				return ipNet.IP.String(), nil
+			}
+		} else if ipv6 == "" && family != familyIPv4 {
+			ipv6 = ipNet.IP.String()
+			if ipNet.IP.IsLinkLocalUnicast() {
+				ipv6 += "%" + iface.Name
+			}
+		}
+	}
+
+	if ipv6 == "" {
+		return "", fmt.Errorf("interface %s has no %s address", name, family)
+	}
+	return ipv6, nil
+}
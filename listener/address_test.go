@@ -0,0 +1,42 @@
+package listener
+
+import (
+	"io/ioutil"
+	"testing"
+
+	l "github.com/Sirupsen/logrus"
+)
+
+func TestListenAddress(t *testing.T) {
+	tests := []struct {
+		configMap map[string]interface{}
+		network   string
+		address   string
+	}{
+		{map[string]interface{}{}, "tcp4", ":2003"},
+		{map[string]interface{}{"bind": "127.0.0.1"}, "tcp4", "127.0.0.1:2003"},
+		{map[string]interface{}{"bind": "::1"}, "tcp6", "[::1]:2003"},
+		{map[string]interface{}{"bind": "fe80::1%lo"}, "tcp6", "[fe80::1%lo]:2003"},
+		{map[string]interface{}{"family": "dual"}, "tcp", ":2003"},
+		{map[string]interface{}{"family": "ipv6"}, "tcp6", ":2003"},
+		{map[string]interface{}{"family": "ipv5"}, "tcp4", ":2003"},
+		{map[string]interface{}{"bind": "::", "family": "dual"}, "tcp", "[::]:2003"},
+	}
+
+	logger := l.New()
+	logger.Out = ioutil.Discard
+	for _, test := range tests {
+		var b baseListener
+		b.log = l.NewEntry(logger)
+		b.configureAddress(test.configMap)
+
+		network, address, err := b.listenAddress("tcp", "2003")
+		if err != nil {
+			t.Errorf("%v: %s", test.configMap, err)
+			continue
+		}
+		if network != test.network || address != test.address {
+			t.Errorf("%v: expected %s %s, got %s %s", test.configMap, test.network, test.address, network, address)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package listener
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+
+	"github.com/tsheasha/relayd/message"
+)
+
+// Framings supported by the stream listeners, set with the "framing" key
+const (
+	// framingRaw relays whatever a single read returns
+	framingRaw = "raw"
+
+	// framingNewline relays newline terminated messages, without the newline
+	framingNewline = "newline"
+
+	// framingLength relays messages prefixed by their length
+	// as a 4 bytes big endian integer
+	framingLength = "length"
+
+	lengthPrefixSize = 4
+
+	// room for the framing around a message of maxMsgSize
+	maxFrameOverhead = 16
+)
+
+// configureFraming returns the framing set in configMap, raw by default
+func (l *baseListener) configureFraming(configMap map[string]interface{}) string {
+	framing, exists := configMap["framing"]
+	if !exists {
+		return framingRaw
+	}
+
+	switch framing {
+	case framingRaw, framingNewline, framingLength:
+		return framing.(string)
+	}
+
+	l.log.Error("Unknown framing ", framing, ", falling back to ", framingRaw)
+	return framingRaw
+}
+
+// readFrames splits the stream into messages according to framing
+// and passes them to the channel until the connection is closed
+func (l *baseListener) readFrames(conn net.Conn, framing string) {
+	var split bufio.SplitFunc
+	switch framing {
+	case framingNewline:
+		split = bufio.ScanLines
+	case framingLength:
+		split = scanLengthPrefixed
+	default:
+		split = scanRaw
+	}
+
+	peer := conn.RemoteAddr()
+	l.scanFrames(conn, split, func(msg []byte) {
+		l.log.Debug("Read: ", string(msg))
+		l.Channel() <- l.stamp(message.Copy(msg), peer, framing)
+	})
+}
+
+// scanFrames calls handle with every frame split out of r until EOF,
+// the frame is only valid until handle returns
+func (l *baseListener) scanFrames(r io.Reader, split bufio.SplitFunc, handle func([]byte)) {
+	bufSize := l.MaxMsgSize() + maxFrameOverhead
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, bufSize), bufSize)
+	scanner.Split(split)
+
+	for scanner.Scan() {
+		handle(scanner.Bytes())
+	}
+
+	if err := scanner.Err(); err != nil {
+		l.countError(err)
+		l.log.Warn("Error while reading message: ", err)
+	}
+}
+
+// scanRaw is a bufio.SplitFunc returning whatever has been read so far
+func scanRaw(data []byte, atEOF bool) (int, []byte, error) {
+	if len(data) == 0 {
+		return 0, nil, nil
+	}
+	return len(data), data, nil
+}
+
+// scanLengthPrefixed is a bufio.SplitFunc for length prefixed messages
+func scanLengthPrefixed(data []byte, atEOF bool) (int, []byte, error) {
+	if len(data) >= lengthPrefixSize {
+		n := lengthPrefixSize + int(binary.BigEndian.Uint32(data))
+		if len(data) >= n {
+			return n, data[lengthPrefixSize:n], nil
+		}
+	}
+
+	if atEOF && len(data) > 0 {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	return 0, nil, nil
+}
@@ -0,0 +1,164 @@
+package listener
+
+import (
+	"bufio"
+	"net"
+	"sync/atomic"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+	"github.com/tsheasha/relayd/graphite"
+	"github.com/tsheasha/relayd/message"
+)
+
+const (
+	// DefaultGraphitePlaintextPort is the default port to listen
+	// on for the Graphite plaintext protocol
+	DefaultGraphitePlaintextPort = "2003"
+
+	// DefaultGraphitePicklePort is the default port to listen
+	// on for the Graphite pickle protocol
+	DefaultGraphitePicklePort = "2004"
+
+	// protocols, set with the "protocol" key
+	graphitePlaintext = "plaintext"
+	graphitePickle    = "pickle"
+)
+
+// Graphite listener type, receives datapoints over TCP in carbon's
+// plaintext or pickle protocol. Every datapoint is passed on as a
+// plaintext line, without newline, with the metric attribute set to
+// its path.
+type Graphite struct {
+	baseListener
+	port     string
+	protocol string
+
+	msgsReceived uint64
+	msgsInvalid  uint64
+}
+
+func init() {
+	RegisterListener("Graphite", newGraphite)
+}
+
+// newGraphite creates a new Graphite listener.
+func newGraphite(channel chan *message.Message, log *l.Entry) Listener {
+	g := new(Graphite)
+
+	g.log = log
+	g.channel = channel
+
+	g.name = "Graphite"
+	g.protocol = graphitePlaintext
+	return g
+}
+
+// Configure the listener
+func (g *Graphite) Configure(configMap map[string]interface{}) {
+	if protocol, exists := configMap["protocol"]; exists {
+		switch protocol {
+		case graphitePlaintext, graphitePickle:
+			g.protocol = protocol.(string)
+		default:
+			g.log.Error("Unknown protocol ", protocol, ", falling back to ", g.protocol)
+		}
+	}
+
+	if port, exists := configMap["port"]; exists {
+		g.port = port.(string)
+	} else if g.protocol == graphitePickle {
+		g.port = DefaultGraphitePicklePort
+	} else {
+		g.port = DefaultGraphitePlaintextPort
+	}
+
+	g.configureAddress(configMap)
+	g.configureCommonParams(configMap)
+}
+
+// Listen passes incoming traffic to the channel to be picked up
+// by forwarder
+func (g *Graphite) Listen() {
+	network, address, err := g.listenAddress("tcp", g.port)
+	if err != nil {
+		g.log.Fatal("Invalid listen address ", err)
+	}
+
+	l, err := net.Listen(network, address)
+	if err != nil {
+		g.log.Fatal("Cannot listen on socket", err)
+	}
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			g.log.Fatal(err)
+		}
+
+		go func(conn net.Conn) {
+			defer conn.Close()
+			peer := conn.RemoteAddr()
+			g.log.Debug("Connection started: ", peer)
+			if g.protocol == graphitePickle {
+				g.scanFrames(conn, scanLengthPrefixed, func(payload []byte) {
+					g.handlePickle(payload, peer)
+				})
+			} else {
+				g.scanFrames(conn, bufio.ScanLines, func(line []byte) {
+					g.handleLine(line, peer)
+				})
+			}
+			g.log.Debug("Connection closed: ", peer)
+		}(conn)
+	}
+}
+
+// InternalMetrics : datapoint counters of the listener
+func (g *Graphite) InternalMetrics() InternalMetrics {
+	m := g.baseListener.InternalMetrics()
+	m.Counters["msgsReceived"] = float64(atomic.LoadUint64(&g.msgsReceived))
+	m.Counters["msgsInvalid"] = float64(atomic.LoadUint64(&g.msgsInvalid))
+	return m
+}
+
+func (g *Graphite) handleLine(line []byte, peer net.Addr) {
+	if len(line) == 0 {
+		return
+	}
+	g.log.Debug("Read: ", string(line))
+	atomic.AddUint64(&g.msgsReceived, 1)
+
+	metric, err := graphite.ParseLine(line)
+	if err != nil {
+		atomic.AddUint64(&g.msgsInvalid, 1)
+		g.log.Debug("Dropping invalid line ", string(line), ": ", err)
+		return
+	}
+	g.emit(metric, peer, message.FramingNewline)
+}
+
+func (g *Graphite) handlePickle(payload []byte, peer net.Addr) {
+	metrics, invalid, err := graphite.DecodePickle(payload)
+	if err != nil {
+		atomic.AddUint64(&g.msgsInvalid, 1)
+		g.log.Warn("Dropping invalid pickle: ", err)
+		return
+	}
+
+	atomic.AddUint64(&g.msgsReceived, uint64(len(metrics)+invalid))
+	atomic.AddUint64(&g.msgsInvalid, uint64(invalid))
+	for _, metric := range metrics {
+		g.emit(metric, peer, message.FramingLength)
+	}
+}
+
+func (g *Graphite) emit(metric graphite.Metric, peer net.Addr, framing string) {
+	if metric.Timestamp == -1 {
+		metric.Timestamp = time.Now().Unix()
+	}
+
+	msg := g.stamp(message.New(metric.AppendLine(nil)), peer, framing)
+	msg.SetAttribute("metric", metric.Path)
+	g.Channel() <- msg
+}
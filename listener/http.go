@@ -0,0 +1,313 @@
+package listener
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+	"github.com/tsheasha/relayd/config"
+	"github.com/tsheasha/relayd/message"
+)
+
+const (
+	// DefaultHTTPListenerPort is the default port
+	// to listen on for incoming HTTP requests
+	DefaultHTTPListenerPort = "19193"
+
+	// DefaultHTTPListenerPath is the path messages are POSTed to
+	DefaultHTTPListenerPath = "/"
+
+	// DefaultMaxBodySize caps the size of a batch request
+	DefaultMaxBodySize = 8388608
+
+	// DefaultBackpressureTimeout is how long (ms) a request waits
+	// for the pipeline before it's rejected with a 429
+	DefaultBackpressureTimeout = 100
+)
+
+// Supported request body formats
+const (
+	httpFormatRaw   = "raw"   // the whole body is one message
+	httpFormatLines = "lines" // newline delimited messages
+	httpFormatJSON  = "json"  // JSON array, one message per element
+)
+
+// httpFramings maps the formats to the framing recorded in messages
+var httpFramings = map[string]string{
+	httpFormatRaw:   message.FramingRaw,
+	httpFormatLines: message.FramingNewline,
+	httpFormatJSON:  message.FramingJSON,
+}
+
+// HTTP listener type
+type HTTP struct {
+	baseListener
+	port                string
+	path                string
+	format              string
+	maxBodySize         int
+	backpressureTimeout time.Duration
+
+	requests           uint64
+	requestsAccepted   uint64
+	requestsRejected   uint64
+	requestsInvalid    uint64
+	requestsNotAllowed uint64
+	msgsReceived       uint64
+
+	// held while a request's messages are passed on, for the room
+	// found in the channel to still be there
+	emitLock sync.Mutex
+}
+
+func init() {
+	RegisterListener("HTTP", newHTTP)
+}
+
+// newHTTP creates a new HTTP listener.
+func newHTTP(channel chan *message.Message, log *l.Entry) Listener {
+	h := new(HTTP)
+
+	h.log = log
+	h.channel = channel
+
+	h.name = "HTTP"
+	h.port = DefaultHTTPListenerPort
+	h.path = DefaultHTTPListenerPath
+	h.format = httpFormatRaw
+	h.maxBodySize = DefaultMaxBodySize
+	h.backpressureTimeout = DefaultBackpressureTimeout * time.Millisecond
+	return h
+}
+
+// Configure the listener
+func (h *HTTP) Configure(configMap map[string]interface{}) {
+	if port, exists := configMap["port"]; exists {
+		h.port = port.(string)
+	}
+
+	if path, exists := configMap["path"]; exists {
+		h.path = path.(string)
+	}
+
+	if format, exists := configMap["format"]; exists {
+		switch format {
+		case httpFormatRaw, httpFormatLines, httpFormatJSON:
+			h.format = format.(string)
+		default:
+			h.log.Error("Unknown format ", format, ", falling back to ", h.format)
+		}
+	}
+
+	if size, exists := configMap["maxBodySize"]; exists {
+		h.maxBodySize = config.GetAsInt(size, DefaultMaxBodySize)
+	}
+
+	if timeout, exists := configMap["backpressureTimeout"]; exists {
+		h.backpressureTimeout = time.Duration(config.GetAsInt(timeout, DefaultBackpressureTimeout)) * time.Millisecond
+	}
+
+	h.configureAddress(configMap)
+	h.configureCommonParams(configMap)
+}
+
+// Listen serves POST requests and passes their messages to the
+// channel to be picked up by forwarder
+func (h *HTTP) Listen() {
+	mux := http.NewServeMux()
+	mux.HandleFunc(h.path, h.handleRequest)
+
+	network, address, err := h.listenAddress("tcp", h.port)
+	if err != nil {
+		h.log.Fatal("Invalid listen address ", err)
+	}
+
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		h.log.Fatal("Cannot listen on socket", err)
+	}
+
+	if err := http.Serve(ln, mux); err != nil {
+		h.log.Error("HTTP listener stopped: ", err)
+	}
+}
+
+// InternalMetrics : request and message counters of the listener
+func (h *HTTP) InternalMetrics() InternalMetrics {
+	m := h.baseListener.InternalMetrics()
+	m.Counters["requests"] = float64(atomic.LoadUint64(&h.requests))
+	m.Counters["requestsAccepted"] = float64(atomic.LoadUint64(&h.requestsAccepted))
+	m.Counters["requestsRejected"] = float64(atomic.LoadUint64(&h.requestsRejected))
+	m.Counters["requestsInvalid"] = float64(atomic.LoadUint64(&h.requestsInvalid))
+	m.Counters["requestsNotAllowed"] = float64(atomic.LoadUint64(&h.requestsNotAllowed))
+	m.Counters["msgsReceived"] = float64(atomic.LoadUint64(&h.msgsReceived))
+	return m
+}
+
+func (h *HTTP) handleRequest(writer http.ResponseWriter, req *http.Request) {
+	atomic.AddUint64(&h.requests, 1)
+
+	if req.Method != http.MethodPost {
+		atomic.AddUint64(&h.requestsNotAllowed, 1)
+		writer.Header().Set("Allow", http.MethodPost)
+		http.Error(writer, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit := h.maxBodySize
+	if h.format == httpFormatRaw {
+		limit = h.MaxMsgSize()
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(writer, req.Body, int64(limit)))
+	if err != nil {
+		h.reject(writer, http.StatusRequestEntityTooLarge, fmt.Sprintf("body exceeds %d bytes", limit))
+		return
+	}
+
+	msgs, err := h.split(body)
+	if err != nil {
+		h.reject(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	for _, msg := range msgs {
+		if len(msg) > h.MaxMsgSize() {
+			h.reject(writer, http.StatusRequestEntityTooLarge, fmt.Sprintf("message exceeds %d bytes", h.MaxMsgSize()))
+			return
+		}
+	}
+
+	// the channel would never have room for all of them
+	if size := cap(h.Channel()); size > 0 && len(msgs) > size {
+		h.reject(writer, http.StatusRequestEntityTooLarge, fmt.Sprintf("more than %d messages", size))
+		return
+	}
+
+	// an IP:port, it doesn't need resolving
+	peer, _ := net.ResolveTCPAddr("tcp", req.RemoteAddr)
+
+	if accepted := h.emit(msgs, peer); accepted < len(msgs) {
+		atomic.AddUint64(&h.requestsRejected, 1)
+		writer.Header().Set("Retry-After", "1")
+		if accepted == 0 {
+			http.Error(writer, "backpressured, no message accepted", http.StatusTooManyRequests)
+		} else {
+			// only with an unbuffered channel, tell the client where to resume
+			http.Error(writer, fmt.Sprintf("backpressured, accepted %d of %d messages", accepted, len(msgs)), http.StatusTooManyRequests)
+		}
+		return
+	}
+
+	atomic.AddUint64(&h.requestsAccepted, 1)
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// split turns a request body into messages according to the configured format
+func (h *HTTP) split(body []byte) ([][]byte, error) {
+	switch h.format {
+	case httpFormatLines:
+		var msgs [][]byte
+		for _, line := range bytes.Split(body, []byte("\n")) {
+			line = bytes.TrimSuffix(line, []byte("\r"))
+			if len(line) > 0 {
+				msgs = append(msgs, line)
+			}
+		}
+		return msgs, nil
+	case httpFormatJSON:
+		var elements []json.RawMessage
+		if err := json.Unmarshal(body, &elements); err != nil {
+			return nil, fmt.Errorf("expected a JSON array: %s", err)
+		}
+		msgs := make([][]byte, 0, len(elements))
+		for i, element := range elements {
+			if bytes.Equal(element, []byte("null")) {
+				return nil, fmt.Errorf("element %d is null", i)
+			}
+			// strings are relayed unquoted, anything else as raw JSON
+			var str string
+			if json.Unmarshal(element, &str) == nil {
+				msgs = append(msgs, []byte(str))
+			} else {
+				msgs = append(msgs, element)
+			}
+		}
+		return msgs, nil
+	}
+
+	if len(body) == 0 {
+		return nil, nil
+	}
+	return [][]byte{body}, nil
+}
+
+// emit passes the messages of a request on and returns how many were. Either
+// all of them are, or none if the channel doesn't have room for them within
+// backpressureTimeout. An unbuffered channel never has room, the messages are
+// passed on one at a time then and the ones before the first that couldn't be
+// within backpressureTimeout are.
+func (h *HTTP) emit(msgs [][]byte, peer *net.TCPAddr) int {
+	var addr net.Addr
+	if peer != nil {
+		addr = peer
+	}
+
+	ms := make([]*message.Message, len(msgs))
+	for i, msg := range msgs {
+		ms[i] = h.describe(message.New(msg), addr, httpFramings[h.format])
+		h.delay(ms[i])
+	}
+
+	h.emitLock.Lock()
+	defer h.emitLock.Unlock()
+
+	channel := h.Channel()
+	deadline := time.Now().Add(h.backpressureTimeout)
+	if cap(channel) > 0 {
+		// only this goroutine sends on the channel while the lock is held,
+		// the room found can only grow
+		for cap(channel)-len(channel) < len(ms) {
+			if time.Now().After(deadline) {
+				releaseAll(ms)
+				return 0
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	for i, m := range ms {
+		// counted from msgs since the forwarders may release m as soon as it's sent
+		select {
+		case channel <- m:
+			h.countEmitted(len(msgs[i]))
+			atomic.AddUint64(&h.msgsReceived, 1)
+			h.log.Debug("Read: ", string(msgs[i]))
+		case <-timer.C:
+			releaseAll(ms[i:])
+			return i
+		}
+	}
+	return len(ms)
+}
+
+func releaseAll(ms []*message.Message) {
+	for _, m := range ms {
+		m.Release()
+	}
+}
+
+func (h *HTTP) reject(writer http.ResponseWriter, status int, reason string) {
+	atomic.AddUint64(&h.requestsInvalid, 1)
+	http.Error(writer, reason, status)
+}
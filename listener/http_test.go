@@ -0,0 +1,125 @@
+package listener
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	l "github.com/Sirupsen/logrus"
+	"github.com/tsheasha/relayd/message"
+)
+
+func newTestHTTP(channelSize int, configMap map[string]interface{}) *HTTP {
+	logger := l.New()
+	logger.Out = ioutil.Discard
+	h := newHTTP(make(chan *message.Message, channelSize), l.NewEntry(logger)).(*HTTP)
+	configMap["channelSize"] = channelSize
+	configMap["backpressureTimeout"] = 10
+	h.Configure(configMap)
+	return h
+}
+
+func post(h *HTTP, method, body string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	h.handleRequest(recorder, httptest.NewRequest(method, "/", strings.NewReader(body)))
+	return recorder
+}
+
+// drain returns the payloads of the messages waiting in the channel
+func drain(h *HTTP) []string {
+	var payloads []string
+	for len(h.Channel()) > 0 {
+		msg := <-h.Channel()
+		payloads = append(payloads, string(msg.Payload))
+		msg.Release()
+	}
+	return payloads
+}
+
+func TestHTTPHandleRequest(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   string
+		method   string
+		body     string
+		status   int
+		payloads []string
+	}{
+		{"raw", "raw", http.MethodPost, "a b", http.StatusNoContent, []string{"a b"}},
+		{"raw empty", "raw", http.MethodPost, "", http.StatusNoContent, nil},
+		{"lines", "lines", http.MethodPost, "a\r\nb\n\nc", http.StatusNoContent, []string{"a", "b", "c"}},
+		{"json", "json", http.MethodPost, `["a", {"b": 1}, 2]`, http.StatusNoContent, []string{"a", `{"b": 1}`, "2"}},
+		{"json null", "json", http.MethodPost, `["a", null]`, http.StatusBadRequest, nil},
+		{"json object", "json", http.MethodPost, `{"a": 1}`, http.StatusBadRequest, nil},
+		{"too many messages", "lines", http.MethodPost, "a\nb\nc\nd\ne", http.StatusRequestEntityTooLarge, nil},
+		{"get", "raw", http.MethodGet, "", http.StatusMethodNotAllowed, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := newTestHTTP(4, map[string]interface{}{"format": test.format})
+
+			response := post(h, test.method, test.body)
+			if response.Code != test.status {
+				t.Fatalf("expected status %d, got %d: %s", test.status, response.Code, response.Body)
+			}
+			if payloads := drain(h); strings.Join(payloads, "|") != strings.Join(test.payloads, "|") {
+				t.Errorf("expected messages %q, got %q", test.payloads, payloads)
+			}
+		})
+	}
+}
+
+func TestHTTPCountsRequests(t *testing.T) {
+	h := newTestHTTP(4, map[string]interface{}{"format": "json"})
+
+	post(h, http.MethodPost, `["a"]`)
+	post(h, http.MethodPost, `[null]`)
+	post(h, http.MethodGet, "")
+	post(h, http.MethodPut, "")
+
+	expected := map[string]float64{
+		"requests":           4,
+		"requestsAccepted":   1,
+		"requestsInvalid":    1,
+		"requestsNotAllowed": 2,
+		"requestsRejected":   0,
+		"msgsReceived":       1,
+	}
+	counters := h.InternalMetrics().Counters
+	for name, value := range expected {
+		if counters[name] != value {
+			t.Errorf("expected %s %v, got %v", name, value, counters[name])
+		}
+	}
+}
+
+func TestHTTPBackpressureIsAllOrNothing(t *testing.T) {
+	h := newTestHTTP(4, map[string]interface{}{"format": "lines"})
+
+	if response := post(h, http.MethodPost, "a\nb\nc"); response.Code != http.StatusNoContent {
+		t.Fatalf("expected the first request to be accepted, got %d", response.Code)
+	}
+
+	// only one slot left, none of the messages may be passed on
+	response := post(h, http.MethodPost, "d\ne")
+	if response.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected a 429, got %d", response.Code)
+	}
+	if response.Header().Get("Retry-After") == "" {
+		t.Error("expected a Retry-After header")
+	}
+	if payloads := drain(h); strings.Join(payloads, "") != "abc" {
+		t.Errorf("expected only the first request's messages, got %q", payloads)
+	}
+	if rejected := atomic.LoadUint64(&h.requestsRejected); rejected != 1 {
+		t.Errorf("expected 1 rejected request, got %d", rejected)
+	}
+
+	if response := post(h, http.MethodPost, "d\ne"); response.Code != http.StatusNoContent {
+		t.Errorf("expected the retry to be accepted once there's room, got %d", response.Code)
+	}
+}
@@ -0,0 +1,245 @@
+package listener
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	l "github.com/Sirupsen/logrus"
+	"github.com/tsheasha/relayd/config"
+	"github.com/tsheasha/relayd/kafkaconfig"
+	"github.com/tsheasha/relayd/message"
+)
+
+const (
+	// DefaultKafkaConsumerGroup is the consumer group
+	// used when none is configured
+	DefaultKafkaConsumerGroup = "relayd"
+
+	kafkaRetryInterval = 5 * time.Second
+)
+
+// Kafka listener consumes records from a set of topics as part of a
+// consumer group. Offsets are only marked for commit once every forwarder
+// has sent the record, see done. Records carry the topic, partition and
+// offset attributes they were read at.
+type Kafka struct {
+	baseListener
+
+	brokers []string
+	topics  []string
+	group   string
+	conf    *sarama.Config
+
+	// set when the configuration is unusable, Listen won't connect
+	confErr error
+
+	// the current session and when it started, offsets of the records
+	// read before that are no longer ours to mark
+	sessionMu    sync.Mutex
+	session      sarama.ConsumerGroupSession
+	sessionStart time.Time
+
+	// the partitions of the session with a record that wasn't sent, their
+	// offsets aren't marked past it any more
+	failed map[kafkaPartition]bool
+}
+
+type kafkaPartition struct {
+	topic     string
+	partition int32
+}
+
+func init() {
+	RegisterListener("Kafka", newKafka)
+}
+
+// newKafka creates a new Kafka listener.
+func newKafka(channel chan *message.Message, log *l.Entry) Listener {
+	k := new(Kafka)
+
+	k.log = log
+	k.channel = channel
+
+	k.name = "Kafka"
+	k.group = DefaultKafkaConsumerGroup
+	return k
+}
+
+// Configure the listener
+func (k *Kafka) Configure(configMap map[string]interface{}) {
+	k.conf = sarama.NewConfig()
+	k.conf.Consumer.Return.Errors = true
+
+	if v, exists := configMap["brokers"]; exists {
+		k.brokers = config.GetAsSlice(v)
+	}
+
+	if v, exists := configMap["topics"]; exists {
+		k.topics = config.GetAsSlice(v)
+	}
+
+	if v, exists := configMap["group"]; exists {
+		k.group = fmt.Sprint(v)
+	}
+
+	var errs []string
+	if v, exists := configMap["offset_initial"]; exists {
+		switch strings.ToLower(fmt.Sprint(v)) {
+		case "oldest":
+			k.conf.Consumer.Offsets.Initial = sarama.OffsetOldest
+		case "newest":
+			k.conf.Consumer.Offsets.Initial = sarama.OffsetNewest
+		default:
+			errs = append(errs, fmt.Sprintf("invalid offset_initial %v, expected oldest or newest", v))
+		}
+	}
+
+	if v, exists := configMap["commit_interval"]; exists {
+		n, err := kafkaconfig.ParseInt("commit_interval", v, 1)
+		if err != nil {
+			errs = append(errs, err.Error())
+		} else {
+			k.conf.Consumer.Offsets.AutoCommit.Interval = time.Duration(n) * time.Millisecond
+		}
+	}
+
+	errs = append(errs, kafkaconfig.Configure(k.conf, configMap)...)
+
+	if len(k.brokers) == 0 {
+		errs = append(errs, "no brokers specified")
+	}
+
+	if len(k.topics) == 0 {
+		errs = append(errs, "no topics specified")
+	}
+
+	if len(errs) == 0 {
+		if err := k.conf.Validate(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		k.confErr = errors.New(strings.Join(errs, "; "))
+		k.log.Error("Invalid Kafka configuration: ", k.confErr)
+	}
+
+	k.configureCommonParams(configMap)
+}
+
+// Listen joins the consumer group and passes the consumed records
+// to the channel to be picked up by forwarder
+func (k *Kafka) Listen() {
+	if k.confErr != nil {
+		k.log.Error("Not starting Kafka consumer, invalid configuration: ", k.confErr)
+		return
+	}
+
+	group, err := sarama.NewConsumerGroup(k.brokers, k.group, k.conf)
+	if err != nil {
+		k.log.Error("Failed to create Kafka consumer group ", err)
+		return
+	}
+	defer group.Close()
+
+	go func() {
+		for err := range group.Errors() {
+			k.countError(err)
+			k.log.Warn("Kafka consumer error: ", err)
+		}
+	}()
+
+	// Consume returns on every rebalance, so it has to be called again
+	for {
+		if err := group.Consume(context.Background(), k.topics, k); err != nil {
+			k.log.Error("Kafka consumer group failed: ", err)
+			time.Sleep(kafkaRetryInterval)
+		}
+	}
+}
+
+// Setup is run at the beginning of a new session, before ConsumeClaim.
+func (k *Kafka) Setup(session sarama.ConsumerGroupSession) error {
+	k.sessionMu.Lock()
+	k.session = session
+	k.sessionStart = time.Now()
+	k.failed = make(map[kafkaPartition]bool)
+	k.sessionMu.Unlock()
+
+	k.log.Info("Kafka session started, claims: ", session.Claims())
+	return nil
+}
+
+// Cleanup is run at the end of a session, once all ConsumeClaim goroutines have exited.
+func (k *Kafka) Cleanup(session sarama.ConsumerGroupSession) error {
+	k.sessionMu.Lock()
+	k.session = nil
+	k.sessionMu.Unlock()
+
+	k.log.Info("Kafka session ended, generation ", session.GenerationID())
+	return nil
+}
+
+// ConsumeClaim emits the records of a single partition.
+func (k *Kafka) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for record := range claim.Messages() {
+		k.log.Debug("Read: ", string(record.Value))
+		k.emit(session, record)
+	}
+	return nil
+}
+
+func (k *Kafka) emit(session sarama.ConsumerGroupSession, record *sarama.ConsumerMessage) {
+	msg := message.New(record.Value)
+	msg.SetAttribute("topic", record.Topic)
+	msg.SetAttribute("partition", strconv.FormatInt(int64(record.Partition), 10))
+	msg.SetAttribute("offset", strconv.FormatInt(record.Offset, 10))
+	msg.OnDone(k.done)
+
+	k.Channel() <- k.stamp(msg, nil, message.FramingRecord)
+}
+
+// done marks the offset of msg for commit once every forwarder is done with
+// it, if they all sent it. Otherwise the partition's offset stays before msg
+// for the rest of the session, msg is read again by the next one. Records
+// read in an earlier session aren't marked, their partition may belong to
+// another consumer by now.
+func (k *Kafka) done(msg *message.Message, ok bool) {
+	topic, _ := msg.Attribute("topic")
+	partition, _ := msg.Attribute("partition")
+	offset, _ := msg.Attribute("offset")
+
+	p, err := strconv.ParseInt(partition, 10, 32)
+	if err != nil {
+		return
+	}
+	o, err := strconv.ParseInt(offset, 10, 64)
+	if err != nil {
+		return
+	}
+
+	k.sessionMu.Lock()
+	defer k.sessionMu.Unlock()
+
+	if k.session == nil || msg.Received.Before(k.sessionStart) {
+		return
+	}
+
+	claim := kafkaPartition{topic, int32(p)}
+	if !ok {
+		k.log.Warn("Record ", o, " of ", topic, "/", p, " wasn't sent, not committing the partition any further")
+		k.failed[claim] = true
+		return
+	}
+	if k.failed[claim] {
+		return
+	}
+	// the committed offset is the next one to read
+	k.session.MarkOffset(topic, int32(p), o+1, "")
+}
@@ -0,0 +1,134 @@
+package listener
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	l "github.com/Sirupsen/logrus"
+	"github.com/tsheasha/relayd/message"
+)
+
+// newGroupBroker starts a mock broker coordinating the relayd consumer
+// group, which assigns partition 0 of topic logs, holding records, to it.
+// The responses have the versions sarama's default Kafka version requests.
+func newGroupBroker(t *testing.T, records ...string) *sarama.MockBroker {
+	broker := sarama.NewMockBroker(t, 1)
+
+	fetch := sarama.NewMockFetchResponse(t, len(records)).SetVersion(4)
+	for i, record := range records {
+		fetch.SetMessage("logs", 0, int64(i), sarama.StringEncoder(record))
+	}
+	fetch.SetHighWaterMark("logs", 0, int64(len(records)))
+
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("logs", 0, broker.BrokerID()),
+		"FindCoordinatorRequest": sarama.NewMockFindCoordinatorResponse(t).
+			SetCoordinator(sarama.CoordinatorGroup, DefaultKafkaConsumerGroup, broker),
+		"JoinGroupRequest": sarama.NewMockJoinGroupResponse(t).
+			SetGenerationId(1).
+			SetMemberId("relayd-1").
+			SetLeaderId("relayd-0"),
+		"SyncGroupRequest": sarama.NewMockSyncGroupResponse(t).
+			SetMemberAssignment(&sarama.ConsumerGroupMemberAssignment{
+				Topics: map[string][]int32{"logs": {0}},
+			}),
+		"OffsetFetchRequest": sarama.NewMockOffsetFetchResponse(t).
+			SetOffset(DefaultKafkaConsumerGroup, "logs", 0, -1, "", sarama.ErrNoError),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetVersion(1).
+			SetOffset("logs", 0, sarama.OffsetOldest, 0).
+			SetOffset("logs", 0, sarama.OffsetNewest, int64(len(records))),
+		"FetchRequest":        fetch,
+		"HeartbeatRequest":    sarama.NewMockHeartbeatResponse(t),
+		"OffsetCommitRequest": sarama.NewMockOffsetCommitResponse(t),
+		"LeaveGroupRequest":   sarama.NewMockLeaveGroupResponse(t),
+	})
+	return broker
+}
+
+// committed returns the highest offset of logs/0 committed to broker, -1 if none
+func committed(broker *sarama.MockBroker) int64 {
+	highest := int64(-1)
+	for _, rr := range broker.History() {
+		if req, ok := rr.Request.(*sarama.OffsetCommitRequest); ok {
+			if offset, _, err := req.Offset("logs", 0); err == nil && offset > highest {
+				highest = offset
+			}
+		}
+	}
+	return highest
+}
+
+// consume runs a Kafka listener against broker and hands every record it
+// emits to relay, which releases it as the forwarders would
+func consume(t *testing.T, broker *sarama.MockBroker, relay func(*message.Message)) {
+	logger := l.New()
+	logger.Out = ioutil.Discard
+	channel := make(chan *message.Message)
+	k := newKafka(channel, l.NewEntry(logger)).(*Kafka)
+	k.Configure(map[string]interface{}{
+		"brokers":         []interface{}{broker.Addr()},
+		"topics":          []interface{}{"logs"},
+		"offset_initial":  "oldest",
+		"commit_interval": 10,
+	})
+	if k.confErr != nil {
+		t.Fatal(k.confErr)
+	}
+
+	go k.Listen()
+	go func() {
+		for msg := range channel {
+			relay(msg)
+		}
+	}()
+}
+
+// waitCommitted waits for offset to be committed, and a little longer to
+// see that nothing past it is
+func waitCommitted(t *testing.T, broker *sarama.MockBroker, offset int64) {
+	deadline := time.Now().Add(10 * time.Second)
+	for committed(broker) < offset && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	if got := committed(broker); got != offset {
+		t.Errorf("expected offset %d to be committed, got %d", offset, got)
+	}
+}
+
+func TestKafkaCommitsSentRecords(t *testing.T) {
+	broker := newGroupBroker(t, "a", "b", "c")
+	defer broker.Close()
+
+	// two forwarders, both sending every record
+	consume(t, broker, func(msg *message.Message) {
+		msg.Retain(1)
+		msg.Release()
+		msg.Release()
+	})
+
+	waitCommitted(t, broker, 3)
+}
+
+func TestKafkaDoesNotCommitPastUnsentRecord(t *testing.T) {
+	broker := newGroupBroker(t, "a", "b", "c")
+	defer broker.Close()
+
+	// the second forwarder fails to send b, c is sent by both
+	consume(t, broker, func(msg *message.Message) {
+		msg.Retain(1)
+		msg.Release()
+		if string(msg.Payload) == "b" {
+			msg.Fail()
+		}
+		msg.Release()
+	})
+
+	waitCommitted(t, broker, 1)
+}
@@ -1,8 +1,15 @@
 package listener
 
 import (
+	"net"
+	"sync/atomic"
+	"time"
+
 	l "github.com/Sirupsen/logrus"
 	"github.com/tsheasha/relayd/config"
+	"github.com/tsheasha/relayd/message"
+	"github.com/tsheasha/relayd/rate"
+	"github.com/tsheasha/relayd/ratelimit"
 )
 
 const (
@@ -13,6 +20,10 @@ const (
 	// DefaultMaxMsgSize indicates the maximum message
 	// size to be received by a listener
 	DefaultMaxMsgSize = 65536
+
+	// DefaultChannelSize is how many messages a listener can
+	// read ahead of the forwarders before it blocks
+	DefaultChannelSize = 100
 )
 
 var defaultLog = l.WithFields(l.Fields{"app": "relayd", "pkg": "listener"})
@@ -22,19 +33,40 @@ type Listener interface {
 	Listen()
 	Configure(map[string]interface{})
 
+	// InternalMetrics is to publish a set of values
+	// that are relevant to the listener itself.
+	InternalMetrics() InternalMetrics
+
 	// taken care of by the base class
-	Channel() chan []byte
+	Channel() chan *message.Message
 	MaxMsgSize() int
 	Name() string
 	ReadBuffer() int
+
+	// nil unless rateLimit is set
+	RateLimiter() *ratelimit.Limiter
 }
 
-var listenerConstructs map[string]func(chan []byte, *l.Entry) Listener
+// InternalMetrics holds the key:value pairs for counters/gauges
+type InternalMetrics struct {
+	Counters map[string]float64
+	Gauges   map[string]float64
+}
+
+// NewInternalMetrics initializes the internal components of InternalMetrics
+func NewInternalMetrics() *InternalMetrics {
+	inst := new(InternalMetrics)
+	inst.Counters = make(map[string]float64)
+	inst.Gauges = make(map[string]float64)
+	return inst
+}
+
+var listenerConstructs map[string]func(chan *message.Message, *l.Entry) Listener
 
 // RegisterListener composes a map of listener names -> factory functions
-func RegisterListener(name string, f func(chan []byte, *l.Entry) Listener) {
+func RegisterListener(name string, f func(chan *message.Message, *l.Entry) Listener) {
 	if listenerConstructs == nil {
-		listenerConstructs = make(map[string]func(chan []byte, *l.Entry) Listener)
+		listenerConstructs = make(map[string]func(chan *message.Message, *l.Entry) Listener)
 	}
 	listenerConstructs[name] = f
 }
@@ -43,7 +75,7 @@ func RegisterListener(name string, f func(chan []byte, *l.Entry) Listener) {
 func New(name string) Listener {
 	var listener Listener
 
-	channel := make(chan []byte)
+	channel := make(chan *message.Message, DefaultChannelSize)
 	listenerLog := defaultLog.WithFields(l.Fields{"listener": name})
 
 	if f, exists := listenerConstructs[name]; exists {
@@ -58,11 +90,29 @@ func New(name string) Listener {
 
 type baseListener struct {
 	// fulfill most of the rote parts of the listener interface
-	channel    chan []byte
+	channel    chan *message.Message
 	maxMsgSize int
 	name       string
 	readBuffer int
 
+	// where socket listeners bind, see configureAddress
+	bind   string
+	iface  string
+	family string
+
+	// deepest the channel was seen when sending to it
+	channelHighWater uint64
+
+	// messages passed on and their payload bytes
+	msgsEmitted  uint64
+	bytesEmitted uint64
+	emitted      rate.Meter
+
+	errorsRead    uint64
+	errorsTimeout uint64
+
+	rateLimiter *ratelimit.Limiter
+
 	// intentionally exported
 	log *l.Entry
 }
@@ -77,29 +127,138 @@ func (l *baseListener) configureCommonParams(configMap map[string]interface{}) {
 	if m, exists := configMap["maxMsgSize"]; exists {
 		l.maxMsgSize = config.GetAsInt(m, DefaultMaxMsgSize)
 	}
+
+	if r, exists := configMap["rateLimit"]; exists {
+		limiter, err := ratelimit.Parse(r)
+		if err != nil {
+			l.log.Error("Invalid rateLimit, ignoring it: ", err)
+		}
+		l.rateLimiter = limiter
+	}
+
+	// the channel isn't in use before the listener is configured
+	if c, exists := configMap["channelSize"]; exists {
+		size := config.GetAsInt(c, DefaultChannelSize)
+		if size < 0 {
+			l.log.Error("Invalid channelSize ", c, ", falling back to ", DefaultChannelSize)
+			size = DefaultChannelSize
+		}
+		l.channel = make(chan *message.Message, size)
+	}
+}
+
+// stamp records where, when and how msg was received, peer may be nil.
+// Every message is stamped right before being sent on the channel, so
+// this is where the channel depth is sampled and messages are counted.
+// A listener that may give up sending uses describe, delay and countEmitted.
+func (l *baseListener) stamp(msg *message.Message, peer net.Addr, framing string) *message.Message {
+	l.describe(msg, peer, framing)
+	l.delay(msg)
+	l.countEmitted(len(msg.Payload))
+	return msg
+}
+
+// delay holds msg for as long as it's over a rateLimit with the delay
+// action. It runs in the goroutine that read msg, so that only its
+// connection waits rather than every message of the listener.
+func (l *baseListener) delay(msg *message.Message) {
+	if l.rateLimiter != nil && l.rateLimiter.Action() == ratelimit.Delay {
+		l.rateLimiter.Take(msg, len(msg.Payload))
+	}
+}
+
+// describe records where, when and how msg was received
+func (l *baseListener) describe(msg *message.Message, peer net.Addr, framing string) *message.Message {
+	msg.Received = time.Now()
+	msg.Source = l.name
+	msg.Peer = peer
+	msg.Framing = framing
+	return msg
+}
+
+// countEmitted counts a message of size bytes passed on
+// and samples the channel depth
+func (l *baseListener) countEmitted(size int) {
+	storeMax(&l.channelHighWater, uint64(len(l.channel)))
+	atomic.AddUint64(&l.msgsEmitted, 1)
+	atomic.AddUint64(&l.bytesEmitted, uint64(size))
+	l.emitted.Mark(size)
 }
 
 // Channel : the channel on which the listener should send messages
-func (l baseListener) Channel() chan []byte {
+func (l *baseListener) Channel() chan *message.Message {
 	return l.channel
 }
 
 // ReadBuffer : the OS level protocol socket buffer
-func (l baseListener) ReadBuffer() int {
+func (l *baseListener) ReadBuffer() int {
 	return l.readBuffer
 }
 
 // MaxMsgSize : max size of incoming message
-func (l baseListener) MaxMsgSize() int {
+func (l *baseListener) MaxMsgSize() int {
 	return l.maxMsgSize
 }
 
 // Name : the name of the listener
-func (l baseListener) Name() string {
+func (l *baseListener) Name() string {
 	return l.name
 }
 
+// RateLimiter : the limiter of the messages received, if any
+func (l *baseListener) RateLimiter() *ratelimit.Limiter {
+	return l.rateLimiter
+}
+
+// countError counts a failed read, by whether it timed out
+func (l *baseListener) countError(err error) {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		atomic.AddUint64(&l.errorsTimeout, 1)
+	} else {
+		atomic.AddUint64(&l.errorsRead, 1)
+	}
+}
+
+// InternalMetrics : the counters and gauges every listener has,
+// listeners add their own metrics
+func (l *baseListener) InternalMetrics() InternalMetrics {
+	m := NewInternalMetrics()
+	m.Counters["msgsEmitted"] = float64(atomic.LoadUint64(&l.msgsEmitted))
+	m.Counters["bytesEmitted"] = float64(atomic.LoadUint64(&l.bytesEmitted))
+	m.Counters["errorsRead"] = float64(atomic.LoadUint64(&l.errorsRead))
+	m.Counters["errorsTimeout"] = float64(atomic.LoadUint64(&l.errorsTimeout))
+
+	// per second rates, suffixed with their window
+	msgsRates, bytesRates := l.emitted.Rates()
+	for window := range rate.Windows {
+		m.Gauges["msgsEmittedRate"+window] = msgsRates[window]
+		m.Gauges["bytesEmittedRate"+window] = bytesRates[window]
+	}
+
+	m.Gauges["queueLength"] = float64(len(l.channel))
+	m.Gauges["queueCapacity"] = float64(cap(l.channel))
+	m.Gauges["queueHighWater"] = float64(atomic.LoadUint64(&l.channelHighWater))
+	if cap(l.channel) > 0 {
+		m.Gauges["queueUtilization"] = float64(len(l.channel)) / float64(cap(l.channel))
+	}
+
+	if l.rateLimiter != nil {
+		l.rateLimiter.AddMetrics(m.Counters, m.Gauges)
+	}
+	return *m
+}
+
 // String returns the listener name in printable format.
-func (l baseListener) String() string {
+func (l *baseListener) String() string {
 	return l.Name() + "Listener"
 }
+
+// storeMax sets *addr to v if v is larger
+func storeMax(addr *uint64, v uint64) {
+	for {
+		current := atomic.LoadUint64(addr)
+		if v <= current || atomic.CompareAndSwapUint64(addr, current, v) {
+			return
+		}
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package listener
+
+import (
+	"errors"
+	"syscall"
+)
+
+// reusePort fails, SO_REUSEPORT isn't available on this platform
+func reusePort(network, address string, c syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT is not supported on this platform")
+}
+
+// reusePortSupported tells whether reusePort can be used
+const reusePortSupported = false
@@ -0,0 +1,192 @@
+package listener
+
+import (
+	"bytes"
+	"net"
+	"sync/atomic"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+	"github.com/tsheasha/relayd/config"
+	"github.com/tsheasha/relayd/message"
+	"github.com/tsheasha/relayd/statsd"
+)
+
+const (
+	// DefaultStatsDListenerPort is the default port
+	// to listen on for incoming StatsD traffic
+	DefaultStatsDListenerPort = "8125"
+
+	// DefaultStatsDFlushInterval is the default interval, in milliseconds,
+	// aggregated metrics are flushed at
+	DefaultStatsDFlushInterval = 10000
+)
+
+// StatsD listener type, splits StatsD packets into lines and drops the ones
+// that aren't valid StatsD. Every metric is passed on as a message of its
+// own, with the metric and type attributes set. With aggregate set the
+// metrics are pre-aggregated and flushed every flushInterval instead.
+type StatsD struct {
+	baseListener
+	port string
+
+	aggregate     bool
+	flushInterval time.Duration
+	aggregator    *statsd.Aggregator
+
+	packetsReceived uint64
+	msgsReceived    uint64
+	msgsInvalid     uint64
+	msgsFlushed     uint64
+}
+
+func init() {
+	RegisterListener("StatsD", newStatsD)
+}
+
+// newStatsD creates a new StatsD listener.
+func newStatsD(channel chan *message.Message, log *l.Entry) Listener {
+	s := new(StatsD)
+
+	s.log = log
+	s.channel = channel
+
+	s.name = "StatsD"
+	s.port = DefaultStatsDListenerPort
+	s.flushInterval = DefaultStatsDFlushInterval * time.Millisecond
+	return s
+}
+
+// Configure the listener
+func (s *StatsD) Configure(configMap map[string]interface{}) {
+	if port, exists := configMap["port"]; exists {
+		s.port = port.(string)
+	}
+
+	if aggregate, exists := configMap["aggregate"]; exists {
+		s.aggregate = config.GetAsBool(aggregate, false)
+	}
+
+	if interval, exists := configMap["flushInterval"]; exists {
+		ms := config.GetAsInt(interval, DefaultStatsDFlushInterval)
+		if ms <= 0 {
+			s.log.Error("Invalid flushInterval ", interval, ", falling back to ", DefaultStatsDFlushInterval)
+			ms = DefaultStatsDFlushInterval
+		}
+		s.flushInterval = time.Duration(ms) * time.Millisecond
+	}
+
+	if s.aggregate {
+		s.aggregator = statsd.NewAggregator()
+	}
+
+	s.configureAddress(configMap)
+	s.configureCommonParams(configMap)
+}
+
+// Listen passes incoming traffic to the channel to be picked up
+// by forwarder
+func (s *StatsD) Listen() {
+	network, address, err := s.listenAddress("udp", s.port)
+	if err != nil {
+		s.log.Fatal("Invalid listen address ", err)
+	}
+
+	addr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		s.log.Fatal("Cannot resolve ", address, err)
+	}
+
+	conn, err := net.ListenUDP(network, addr)
+	if err != nil {
+		s.log.Fatal("Cannot listen on socket", err)
+	}
+	defer conn.Close()
+
+	if s.aggregator != nil {
+		go s.flush()
+	}
+
+	conn.SetReadBuffer(s.ReadBuffer())
+	packet := make([]byte, s.MaxMsgSize())
+
+	for {
+		n, peer, err := conn.ReadFromUDP(packet)
+		if err != nil {
+			s.countError(err)
+			s.log.Warn("Error while reading message: ", err)
+			break
+		}
+		atomic.AddUint64(&s.packetsReceived, 1)
+
+		for _, line := range bytes.Split(packet[:n], []byte("\n")) {
+			if len(line) > 0 {
+				s.handleLine(line, peer)
+			}
+		}
+	}
+}
+
+// InternalMetrics : message counters of the listener
+func (s *StatsD) InternalMetrics() InternalMetrics {
+	m := s.baseListener.InternalMetrics()
+	m.Counters["packetsReceived"] = float64(atomic.LoadUint64(&s.packetsReceived))
+	m.Counters["msgsReceived"] = float64(atomic.LoadUint64(&s.msgsReceived))
+	m.Counters["msgsInvalid"] = float64(atomic.LoadUint64(&s.msgsInvalid))
+	if s.aggregator != nil {
+		m.Counters["msgsFlushed"] = float64(atomic.LoadUint64(&s.msgsFlushed))
+		m.Gauges["metricsAggregated"] = float64(s.aggregator.Len())
+	}
+	return m
+}
+
+// handleLine validates a line and either aggregates or emits it,
+// line points into the read buffer and is copied when emitted as is
+func (s *StatsD) handleLine(line []byte, peer net.Addr) {
+	s.log.Debug("Read: ", string(line))
+	atomic.AddUint64(&s.msgsReceived, 1)
+
+	metrics, err := statsd.Parse(line)
+	if err != nil {
+		atomic.AddUint64(&s.msgsInvalid, 1)
+		s.log.Debug("Dropping invalid line ", string(line), ": ", err)
+		return
+	}
+
+	if s.aggregator != nil {
+		for _, metric := range metrics {
+			s.aggregator.Add(metric)
+		}
+		return
+	}
+
+	if len(metrics) == 1 {
+		s.emit(metrics[0], message.Copy(line), peer)
+		return
+	}
+
+	for _, metric := range metrics {
+		s.emit(metric, message.New(metric.Append(nil)), peer)
+	}
+}
+
+// flush emits the aggregated metrics every flushInterval
+func (s *StatsD) flush() {
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, metric := range s.aggregator.Flush() {
+			s.emit(metric, message.New(metric.Append(nil)), nil)
+			atomic.AddUint64(&s.msgsFlushed, 1)
+		}
+	}
+}
+
+// emit passes msg holding metric on, aggregated metrics have no peer
+func (s *StatsD) emit(metric *statsd.Metric, msg *message.Message, peer net.Addr) {
+	s.stamp(msg, peer, message.FramingNewline)
+	msg.SetAttribute("metric", metric.Name)
+	msg.SetAttribute("type", metric.Type)
+	s.Channel() <- msg
+}
@@ -0,0 +1,217 @@
+package listener
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strconv"
+	"sync/atomic"
+
+	l "github.com/Sirupsen/logrus"
+	"github.com/tsheasha/relayd/config"
+	"github.com/tsheasha/relayd/message"
+	"github.com/tsheasha/relayd/syslog"
+)
+
+const (
+	// DefaultSyslogListenerPort is the default port
+	// to listen on for incoming syslog traffic
+	DefaultSyslogListenerPort = "514"
+
+	// transports, set with the "protocol" key
+	syslogUDP = "udp"
+	syslogTCP = "tcp"
+)
+
+// Syslog listener type, receives RFC 3164 and RFC 5424 messages over
+// UDP or TCP and attaches their header fields as message attributes:
+// format, facility, severity, hostname, appname, procid and msgid.
+type Syslog struct {
+	baseListener
+	port     string
+	protocol string
+
+	// relay the received bytes untouched instead of the MSG part only
+	keepOriginal bool
+
+	msgsReceived uint64
+	msgsUnparsed uint64
+}
+
+func init() {
+	RegisterListener("Syslog", newSyslog)
+}
+
+// newSyslog creates a new Syslog listener.
+func newSyslog(channel chan *message.Message, log *l.Entry) Listener {
+	s := new(Syslog)
+
+	s.log = log
+	s.channel = channel
+
+	s.name = "Syslog"
+	s.port = DefaultSyslogListenerPort
+	s.protocol = syslogUDP
+	return s
+}
+
+// Configure the listener
+func (s *Syslog) Configure(configMap map[string]interface{}) {
+	if port, exists := configMap["port"]; exists {
+		s.port = port.(string)
+	}
+
+	if protocol, exists := configMap["protocol"]; exists {
+		switch protocol {
+		case syslogUDP, syslogTCP:
+			s.protocol = protocol.(string)
+		default:
+			s.log.Error("Unknown protocol ", protocol, ", falling back to ", s.protocol)
+		}
+	}
+
+	if keep, exists := configMap["keepOriginal"]; exists {
+		s.keepOriginal = config.GetAsBool(keep, false)
+	}
+
+	s.configureAddress(configMap)
+	s.configureCommonParams(configMap)
+}
+
+// Listen passes incoming traffic to the channel to be picked up
+// by forwarder
+func (s *Syslog) Listen() {
+	network, address, err := s.listenAddress(s.protocol, s.port)
+	if err != nil {
+		s.log.Fatal("Invalid listen address ", err)
+	}
+
+	if s.protocol == syslogTCP {
+		s.listenTCP(network, address)
+	} else {
+		s.listenUDP(network, address)
+	}
+}
+
+// InternalMetrics : message counters of the listener
+func (s *Syslog) InternalMetrics() InternalMetrics {
+	m := s.baseListener.InternalMetrics()
+	m.Counters["msgsReceived"] = float64(atomic.LoadUint64(&s.msgsReceived))
+	m.Counters["msgsUnparsed"] = float64(atomic.LoadUint64(&s.msgsUnparsed))
+	return m
+}
+
+func (s *Syslog) listenUDP(network, address string) {
+	addr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		s.log.Fatal("Cannot resolve ", address, err)
+	}
+
+	conn, err := net.ListenUDP(network, addr)
+	if err != nil {
+		s.log.Fatal("Cannot listen on socket", err)
+	}
+	defer conn.Close()
+
+	conn.SetReadBuffer(s.ReadBuffer())
+	line := make([]byte, s.MaxMsgSize())
+
+	for {
+		n, peer, err := conn.ReadFromUDP(line)
+		if err != nil {
+			s.countError(err)
+			s.log.Warn("Error while reading message: ", err)
+			break
+		}
+
+		s.emit(line[0:n], peer, message.FramingDatagram)
+	}
+}
+
+func (s *Syslog) listenTCP(network, address string) {
+	l, err := net.Listen(network, address)
+	if err != nil {
+		s.log.Fatal("Cannot listen on socket", err)
+	}
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.log.Fatal(err)
+		}
+
+		go func(conn net.Conn) {
+			defer conn.Close()
+			s.log.Info("Connection started: ", conn.RemoteAddr())
+			s.scanFrames(conn, scanSyslogFrames, func(raw []byte) {
+				s.emit(raw, conn.RemoteAddr(), message.FramingRFC6587)
+			})
+			s.log.Info("Connection closed: ", conn.RemoteAddr())
+		}(conn)
+	}
+}
+
+// emit parses raw and passes it on, unparsable messages are relayed
+// as they are, without attributes. raw is copied, the caller keeps it.
+func (s *Syslog) emit(raw []byte, peer net.Addr, framing string) {
+	s.log.Debug("Read: ", string(raw))
+	atomic.AddUint64(&s.msgsReceived, 1)
+
+	msg := s.stamp(message.Copy(raw), peer, framing)
+	parsed, err := syslog.Parse(msg.Payload)
+	if err != nil {
+		atomic.AddUint64(&s.msgsUnparsed, 1)
+		s.Channel() <- msg
+		return
+	}
+
+	if !s.keepOriginal {
+		msg.Payload = parsed.Msg
+	}
+
+	msg.SetAttribute("format", parsed.Format)
+	msg.SetAttribute("facility", parsed.FacilityName())
+	msg.SetAttribute("severity", parsed.SeverityName())
+	for name, value := range map[string]string{
+		"hostname": parsed.Hostname,
+		"appname":  parsed.AppName,
+		"procid":   parsed.ProcID,
+		"msgid":    parsed.MsgID,
+	} {
+		if value != "" {
+			msg.SetAttribute(name, value)
+		}
+	}
+
+	s.Channel() <- msg
+}
+
+// scanSyslogFrames is a bufio.SplitFunc handling both framings of
+// RFC 6587: octet counting ("LEN SP MSG") and newline terminated
+func scanSyslogFrames(data []byte, atEOF bool) (int, []byte, error) {
+	if len(data) == 0 || data[0] < '1' || data[0] > '9' {
+		return bufio.ScanLines(data, atEOF)
+	}
+
+	space := bytes.IndexByte(data, ' ')
+	if space < 0 {
+		if atEOF {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	}
+
+	n, err := strconv.Atoi(string(data[:space]))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	end := space + 1 + n
+	if len(data) < end {
+		if atEOF {
+			return len(data), data[space+1:], nil
+		}
+		return 0, nil, nil
+	}
+	return end, data[space+1 : end], nil
+}
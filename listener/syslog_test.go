@@ -0,0 +1,50 @@
+package listener
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func TestScanSyslogFrames(t *testing.T) {
+	tests := []struct {
+		name   string
+		in     string
+		frames []string
+	}{
+		{"newline", "<13>a\n<13>b\r\n", []string{"<13>a", "<13>b"}},
+		{"octet counting", "5 <13>a6 <13>bc", []string{"<13>a", "<13>bc"}},
+		{"octet counted newline", "7 <13>a\nb", []string{"<13>a\nb"}},
+		{"mixed", "5 <13>a<13>b\n5 <13>c", []string{"<13>a", "<13>b", "<13>c"}},
+		{"truncated at EOF", "10 <13>a", []string{"<13>a"}},
+		{"unterminated newline at EOF", "<13>a", []string{"<13>a"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			scanner := bufio.NewScanner(strings.NewReader(test.in))
+			scanner.Split(scanSyslogFrames)
+
+			var frames []string
+			for scanner.Scan() {
+				frames = append(frames, scanner.Text())
+			}
+			if err := scanner.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(frames, "|") != strings.Join(test.frames, "|") {
+				t.Errorf("expected %q, got %q", test.frames, frames)
+			}
+		})
+	}
+}
+
+func TestScanSyslogFramesInvalidLength(t *testing.T) {
+	scanner := bufio.NewScanner(strings.NewReader("12x <13>a"))
+	scanner.Split(scanSyslogFrames)
+	for scanner.Scan() {
+	}
+	if scanner.Err() == nil {
+		t.Error("expected an invalid octet count to fail")
+	}
+}
@@ -1,12 +1,14 @@
 package listener
 
 import (
-	"bufio"
+	"crypto/tls"
 	"net"
-	"strings"
+	"strconv"
 	"time"
 
 	l "github.com/Sirupsen/logrus"
+	"github.com/tsheasha/relayd/config"
+	"github.com/tsheasha/relayd/message"
 )
 
 const (
@@ -18,7 +20,9 @@ const (
 // TCP listener type
 type TCP struct {
 	baseListener
-	port string
+	port      string
+	framing   string
+	tlsConfig *tls.Config
 }
 
 func init() {
@@ -26,7 +30,7 @@ func init() {
 }
 
 // newTCP creates a new TCP listener.
-func newTCP(channel chan []byte, log *l.Entry) Listener {
+func newTCP(channel chan *message.Message, log *l.Entry) Listener {
 	t := new(TCP)
 
 	t.log = log
@@ -34,6 +38,7 @@ func newTCP(channel chan []byte, log *l.Entry) Listener {
 
 	t.name = "TCP"
 	t.port = DefaultTCPListenerPort
+	t.framing = framingRaw
 	return t
 }
 
@@ -42,25 +47,39 @@ func (t *TCP) Configure(configMap map[string]interface{}) {
 	if port, exists := configMap["port"]; exists {
 		t.port = port.(string)
 	}
+	t.framing = t.configureFraming(configMap)
+	t.configureAddress(configMap)
+
+	tlsConfig, err := config.GetTLSServerConfig(configMap)
+	if err != nil {
+		t.log.Fatal("Invalid TLS configuration: ", err)
+	}
+	t.tlsConfig = tlsConfig
+
 	t.configureCommonParams(configMap)
 }
 
 // Listen passes incoming traffic to the channel to be picked up
 // by forwarder
 func (t *TCP) Listen() {
-	addr, err := net.ResolveTCPAddr("tcp", ":"+t.port)
+	network, address, err := t.listenAddress("tcp", t.port)
+	if err != nil {
+		t.log.Fatal("Invalid listen address ", err)
+	}
+
+	addr, err := net.ResolveTCPAddr(network, address)
 
 	if err != nil {
 		panic(err)
 	}
 
-	l, err := net.ListenTCP("tcp4", addr)
+	l, err := net.ListenTCP(network, addr)
 	if err != nil {
 		t.log.Fatal("Cannot listen on socket", err)
 	}
 
 	// figure out the port bind for Port()
-	t.port = strings.Split(l.Addr().String(), ":")[1]
+	t.port = strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
 
 	for {
 		conn, err := l.AcceptTCP()
@@ -79,19 +98,12 @@ func (t *TCP) readMessage(conn *net.TCPConn) {
 	conn.SetKeepAlivePeriod(time.Second)
 	conn.SetReadBuffer(t.ReadBuffer())
 
-	reader := bufio.NewReader(conn)
 	t.log.Info("Connection started: ", conn.RemoteAddr())
-
-	line := make([]byte, t.MaxMsgSize())
-
-	for {
-		n, err := reader.Read(line)
-		if err != nil {
-			t.log.Warn("Error while reading message: ", err)
-			break
-		}
-		t.log.Debug("Read: ", string(line[0:n]))
-		t.Channel() <- line[0:n]
+	if t.tlsConfig != nil {
+		// the handshake happens on the first read, failures end up in readFrames
+		t.readFrames(tls.Server(conn, t.tlsConfig), t.framing)
+	} else {
+		t.readFrames(conn, t.framing)
 	}
 	t.log.Info("Connection closed: ", conn.RemoteAddr())
 }
@@ -1,9 +1,16 @@
 package listener
 
 import (
+	"context"
+	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
 
 	l "github.com/Sirupsen/logrus"
+	"github.com/tsheasha/relayd/config"
+	"github.com/tsheasha/relayd/message"
+	"github.com/tsheasha/relayd/udpbatch"
 )
 
 const (
@@ -16,6 +23,22 @@ const (
 type UDP struct {
 	baseListener
 	port string
+
+	// datagrams read per recvmmsg, 1 reads them one at a time
+	batchSize int
+
+	// sockets sharing the port with SO_REUSEPORT, each with its own reader
+	sockets int
+
+	// datagrams received, per socket
+	msgsReceived []uint64
+
+	// statsLock guards what's known of the sockets once they're open,
+	// their inodes and family tell where the kernel lists their drops
+	statsLock     sync.Mutex
+	socketInodes  []uint64
+	socketsIPv6   bool
+	grantedBuffer int
 }
 
 func init() {
@@ -23,7 +46,7 @@ func init() {
 }
 
 // newUDP creates a new UDP listener.
-func newUDP(channel chan []byte, log *l.Entry) Listener {
+func newUDP(channel chan *message.Message, log *l.Entry) Listener {
 	u := new(UDP)
 
 	u.log = log
@@ -31,6 +54,8 @@ func newUDP(channel chan []byte, log *l.Entry) Listener {
 
 	u.name = "UDP"
 	u.port = DefaultUDPListenerPort
+	u.batchSize = 1
+	u.sockets = 1
 	return u
 }
 
@@ -40,35 +65,200 @@ func (u *UDP) Configure(configMap map[string]interface{}) {
 		u.port = port.(string)
 	}
 
+	if batchSize, exists := configMap["batchSize"]; exists {
+		u.batchSize = config.GetAsInt(batchSize, 1)
+		if u.batchSize < 1 {
+			u.log.Error("Invalid batchSize ", batchSize, ", falling back to 1")
+			u.batchSize = 1
+		}
+	}
+
+	if sockets, exists := configMap["sockets"]; exists {
+		u.sockets = config.GetAsInt(sockets, 1)
+		if u.sockets < 1 {
+			u.log.Error("Invalid sockets ", sockets, ", falling back to 1")
+			u.sockets = 1
+		} else if u.sockets > 1 && !reusePortSupported {
+			u.log.Error("SO_REUSEPORT is not supported on this platform, listening on a single socket")
+			u.sockets = 1
+		}
+	}
+	u.msgsReceived = make([]uint64, u.sockets)
+
+	u.configureAddress(configMap)
 	u.configureCommonParams(configMap)
 }
 
 // Listen passes incoming traffic to the channel to be picked up
 // by forwarder
 func (u *UDP) Listen() {
-	addr, err := net.ResolveUDPAddr("udp", ":"+u.port)
-
+	network, address, err := u.listenAddress("udp", u.port)
 	if err != nil {
-		panic(err)
+		u.log.Fatal("Invalid listen address ", err)
 	}
 
-	conn, err := net.ListenUDP("udp4", addr)
+	conns, err := u.listenSockets(network, address)
 	if err != nil {
 		u.log.Fatal("Cannot listen on socket", err)
 	}
+	u.inspectSockets(conns)
+
+	var wg sync.WaitGroup
+	for i, conn := range conns {
+		wg.Add(1)
+		go func(i int, conn *net.UDPConn) {
+			defer wg.Done()
+			defer conn.Close()
+			u.read(conn, &u.msgsReceived[i])
+		}(i, conn)
+	}
+	wg.Wait()
+}
+
+// InternalMetrics : receive counters and datagrams dropped by the kernel,
+// per socket too when there are several, and the receive buffer size
+// configured versus granted by the kernel
+func (u *UDP) InternalMetrics() InternalMetrics {
+	m := u.baseListener.InternalMetrics()
+
+	var total uint64
+	for i := range u.msgsReceived {
+		received := atomic.LoadUint64(&u.msgsReceived[i])
+		total += received
+		if len(u.msgsReceived) > 1 {
+			m.Counters[fmt.Sprintf("msgsReceivedSocket%d", i)] = float64(received)
+		}
+	}
+	m.Counters["msgsReceived"] = float64(total)
+
+	u.statsLock.Lock()
+	inodes := u.socketInodes
+	ipv6 := u.socketsIPv6
+	granted := u.grantedBuffer
+	u.statsLock.Unlock()
+
+	m.Gauges["readBufferConfigured"] = float64(u.ReadBuffer())
+	if granted > 0 {
+		m.Gauges["readBufferGranted"] = float64(granted)
+	}
+
+	if len(inodes) > 0 {
+		if drops, err := kernelDrops(ipv6, inodes); err == nil {
+			var totalDrops uint64
+			for i, dropped := range drops {
+				totalDrops += dropped
+				if len(drops) > 1 {
+					m.Counters[fmt.Sprintf("kernelDropsSocket%d", i)] = float64(dropped)
+				}
+			}
+			m.Counters["kernelDrops"] = float64(totalDrops)
+		}
+	}
+	return m
+}
+
+// inspectSockets sets the receive buffer size of the sockets and records
+// what the kernel granted and their inodes, to look their drops up later
+func (u *UDP) inspectSockets(conns []*net.UDPConn) {
+	for _, conn := range conns {
+		if err := conn.SetReadBuffer(u.ReadBuffer()); err != nil {
+			u.log.Warn("Cannot set the socket receive buffer: ", err)
+		}
+	}
 
-	defer conn.Close()
+	inodes := make([]uint64, 0, len(conns))
+	granted := 0
+	for _, conn := range conns {
+		inode, readBuffer, err := socketInfo(conn)
+		if err != nil {
+			u.log.Debug("Kernel drops won't be reported: ", err)
+			return
+		}
+		inodes = append(inodes, inode)
+		granted = readBuffer
+	}
+
+	if granted < u.ReadBuffer() {
+		u.log.Warn("The kernel granted a receive buffer of ", granted, " bytes instead of ",
+			u.ReadBuffer(), ", raise net.core.rmem_max to avoid drops")
+	}
+
+	u.statsLock.Lock()
+	u.socketInodes = inodes
+	u.socketsIPv6 = conns[0].LocalAddr().(*net.UDPAddr).IP.To4() == nil
+	u.grantedBuffer = granted
+	u.statsLock.Unlock()
+}
+
+// listenSockets opens the configured number of sockets, with SO_REUSEPORT
+// when there's more than one so that they can share the address
+func (u *UDP) listenSockets(network, address string) ([]*net.UDPConn, error) {
+	lc := net.ListenConfig{}
+	if u.sockets > 1 {
+		lc.Control = reusePort
+	}
+
+	conns := make([]*net.UDPConn, 0, u.sockets)
+	for i := 0; i < u.sockets; i++ {
+		pc, err := lc.ListenPacket(context.Background(), network, address)
+		if err != nil {
+			for _, conn := range conns {
+				conn.Close()
+			}
+			return nil, err
+		}
+		conn := pc.(*net.UDPConn)
+		conns = append(conns, conn)
+
+		// with port 0 the rest of the sockets join the one picked for the first
+		address = conn.LocalAddr().String()
+	}
+	return conns, nil
+}
+
+// read passes the datagrams received on conn to the channel
+func (u *UDP) read(conn *net.UDPConn, received *uint64) {
+	if u.batchSize > 1 {
+		if batchConn := udpbatch.New(conn); batchConn != nil {
+			u.readBatches(batchConn, received)
+			return
+		}
+		u.log.Warn("Batched reads are not supported on this platform, reading a datagram at a time")
+	}
 
-	conn.SetReadBuffer(u.ReadBuffer())
 	line := make([]byte, u.MaxMsgSize())
 
 	for {
-		n, err := conn.Read(line)
+		n, peer, err := conn.ReadFromUDP(line)
 		if err != nil {
+			u.countError(err)
 			u.log.Warn("Error while reading message: ", err)
 			break
 		}
+		atomic.AddUint64(received, 1)
 		u.log.Debug("Read: ", string(line[0:n]))
-		u.Channel() <- line[0:n]
+		u.Channel() <- u.stamp(message.Copy(line[0:n]), peer, message.FramingDatagram)
+	}
+}
+
+// readBatches reads up to batchSize datagrams per system call
+func (u *UDP) readBatches(conn udpbatch.Conn, received *uint64) {
+	batch := udpbatch.NewMessages(u.batchSize, u.MaxMsgSize())
+
+	for {
+		n, err := conn.ReadBatch(batch, 0)
+		if err != nil {
+			u.countError(err)
+			u.log.Warn("Error while reading messages: ", err)
+			break
+		}
+		atomic.AddUint64(received, uint64(n))
+
+		for _, datagram := range batch[:n] {
+			// the buffers are reused by the next read
+			msg := message.Copy(datagram.Buffers[0][:datagram.N])
+			u.log.Debug("Read: ", string(msg.Payload))
+			u.Channel() <- u.stamp(msg, datagram.Addr, message.FramingDatagram)
+		}
 	}
 }
@@ -0,0 +1,116 @@
+package listener
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+
+	l "github.com/Sirupsen/logrus"
+	"github.com/tsheasha/relayd/message"
+	"github.com/tsheasha/relayd/udpbatch"
+)
+
+// blast sends datagrams to addr as fast as it can, a batch per system
+// call where supported so that the reader is the bottleneck, until done
+// is closed
+func blast(b *testing.B, addr net.Addr, done chan struct{}) {
+	conn, err := net.DialUDP("udp4", nil, addr.(*net.UDPAddr))
+	if err != nil {
+		b.Error(err)
+		return
+	}
+	defer conn.Close()
+
+	batch := make([]udpbatch.Message, 64)
+	for i := range batch {
+		batch[i].Buffers = [][]byte{[]byte("relayd.benchmark.datagram 1 1500000000")}
+	}
+	batchConn := udpbatch.New(conn)
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		if batchConn != nil {
+			batchConn.WriteBatch(batch, 0)
+		} else {
+			conn.Write(batch[0].Buffers[0])
+		}
+	}
+}
+
+// BenchmarkUDPRead compares the baseline, reading a datagram per system
+// call with ReadFromUDP, to reading batches of them with recvmmsg, over
+// loopback
+func BenchmarkUDPRead(b *testing.B) {
+	benchmarks := []struct {
+		name      string
+		recvmmsg  bool
+		batchSize int
+	}{
+		{"baseline", false, 1},
+		{"recvmmsg/batchSize=1", true, 1},
+		{"recvmmsg/batchSize=8", true, 8},
+		{"recvmmsg/batchSize=32", true, 32},
+	}
+
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			channel := make(chan *message.Message, 1024)
+			logger := l.New()
+			logger.Out = ioutil.Discard
+			u := newUDP(channel, l.NewEntry(logger)).(*UDP)
+			u.Configure(map[string]interface{}{"batchSize": bm.batchSize, "maxMsgSize": 1500})
+
+			conns, err := u.listenSockets("udp4", "127.0.0.1:0")
+			if err != nil {
+				b.Fatal(err)
+			}
+			conn := conns[0]
+
+			// read skips recvmmsg for a batch of 1, go through it anyway
+			var batchConn udpbatch.Conn
+			if bm.recvmmsg {
+				if batchConn = udpbatch.New(conn); batchConn == nil {
+					conn.Close()
+					b.Skip("recvmmsg is not supported on this platform")
+				}
+			}
+
+			stopped := make(chan struct{})
+			go func() {
+				defer close(stopped)
+				if batchConn != nil {
+					u.readBatches(batchConn, &u.msgsReceived[0])
+				} else {
+					u.read(conn, &u.msgsReceived[0])
+				}
+			}()
+
+			done := make(chan struct{})
+			go blast(b, conn.LocalAddr(), done)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				msg := <-channel
+				msg.Release()
+			}
+			b.StopTimer()
+
+			close(done)
+			conn.Close()
+			for drained := false; !drained; {
+				select {
+				case msg := <-channel:
+					msg.Release()
+				case <-stopped:
+					drained = true
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package listener
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// socketInfo returns the inode of the socket, which identifies it in
+// /proc/net/udp, and the receive buffer size granted by the kernel. The
+// kernel doubles the size it's asked for to account for its own overhead
+// and caps it at net.core.rmem_max, the halved value is comparable to
+// readBuffer.
+func socketInfo(conn *net.UDPConn) (inode uint64, readBuffer int, err error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		var st unix.Stat_t
+		if sockErr = unix.Fstat(int(fd), &st); sockErr != nil {
+			return
+		}
+		inode = st.Ino
+		readBuffer, sockErr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF)
+	})
+	if err == nil {
+		err = sockErr
+	}
+	return inode, readBuffer / 2, err
+}
+
+// kernelDrops returns the datagrams the kernel dropped on each of the
+// sockets, mostly because their receive buffer was full. Sockets are
+// listed by inode in /proc/net/udp, or /proc/net/udp6 for IPv6 ones.
+func kernelDrops(ipv6 bool, inodes []uint64) ([]uint64, error) {
+	path := "/proc/net/udp"
+	if ipv6 {
+		path = "/proc/net/udp6"
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	index := make(map[uint64]int, len(inodes))
+	for i, inode := range inodes {
+		index[inode] = i
+	}
+	drops := make([]uint64, len(inodes))
+
+	// the inode (10th) and drops (13th) columns:
+	//
+	//	sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode ref pointer drops
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header
+	for found := 0; found < len(inodes) && scanner.Scan(); {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 13 {
+			continue
+		}
+
+		inode, err := strconv.ParseUint(fields[9], 10, 64)
+		if err != nil {
+			continue
+		}
+		i, ok := index[inode]
+		if !ok {
+			continue
+		}
+		if drops[i], err = strconv.ParseUint(fields[12], 10, 64); err != nil {
+			return nil, err
+		}
+		found++
+	}
+	return drops, scanner.Err()
+}
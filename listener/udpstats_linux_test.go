@@ -0,0 +1,49 @@
+package listener
+
+import (
+	"net"
+	"testing"
+)
+
+func TestKernelDrops(t *testing.T) {
+	for _, network := range []string{"udp4", "udp6"} {
+		t.Run(network, func(t *testing.T) {
+			conn, err := net.ListenUDP(network, nil)
+			if err != nil {
+				t.Skip(err)
+			}
+			defer conn.Close()
+
+			// nothing reads, the smallest buffer overflows at once
+			conn.SetReadBuffer(1)
+			inode, _, err := socketInfo(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sender, err := net.DialUDP(network, nil, conn.LocalAddr().(*net.UDPAddr))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sender.Close()
+			datagram := make([]byte, 1000)
+			for i := 0; i < 100; i++ {
+				sender.Write(datagram)
+			}
+
+			ipv6 := network == "udp6"
+			drops, err := kernelDrops(ipv6, []uint64{0, inode})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(drops) != 2 || drops[0] != 0 || drops[1] == 0 {
+				t.Errorf("expected drops for the socket only, got %v", drops)
+			}
+
+			// the other family's file doesn't list the socket
+			if drops, err := kernelDrops(!ipv6, []uint64{inode}); err == nil && drops[0] != 0 {
+				t.Errorf("expected no drops in the other file, got %v", drops)
+			}
+		})
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package listener
+
+import (
+	"errors"
+	"net"
+)
+
+var errKernelStatsUnsupported = errors.New("kernel socket statistics are only available on Linux")
+
+// socketInfo is only implemented on Linux
+func socketInfo(conn *net.UDPConn) (inode uint64, readBuffer int, err error) {
+	return 0, 0, errKernelStatsUnsupported
+}
+
+// kernelDrops is only implemented on Linux
+func kernelDrops(ipv6 bool, inodes []uint64) ([]uint64, error) {
+	return nil, errKernelStatsUnsupported
+}
@@ -0,0 +1,234 @@
+package listener
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+
+	l "github.com/Sirupsen/logrus"
+	"github.com/tsheasha/relayd/message"
+)
+
+const (
+	// DefaultUnixListenerPath is the default path of
+	// the socket to listen on for local traffic
+	DefaultUnixListenerPath = "/var/run/relayd/relayd.sock"
+
+	// socket types, set with the "type" key
+	unixStream   = "stream"
+	unixDatagram = "datagram"
+)
+
+// Unix listener type, listens on a unix domain socket
+// either as a stream (SOCK_STREAM) or datagram (SOCK_DGRAM) socket
+type Unix struct {
+	baseListener
+	path       string
+	socketType string
+	framing    string
+
+	// socket file permissions and ownership
+	mode  os.FileMode
+	owner string
+	group string
+}
+
+func init() {
+	RegisterListener("Unix", newUnix)
+}
+
+// newUnix creates a new Unix listener.
+func newUnix(channel chan *message.Message, log *l.Entry) Listener {
+	u := new(Unix)
+
+	u.log = log
+	u.channel = channel
+
+	u.name = "Unix"
+	u.path = DefaultUnixListenerPath
+	u.socketType = unixStream
+	u.framing = framingRaw
+	return u
+}
+
+// Configure the listener
+func (u *Unix) Configure(configMap map[string]interface{}) {
+	if path, exists := configMap["path"]; exists {
+		u.path = path.(string)
+	}
+
+	if socketType, exists := configMap["type"]; exists {
+		switch socketType {
+		case unixStream, unixDatagram:
+			u.socketType = socketType.(string)
+		default:
+			u.log.Error("Unknown socket type ", socketType, ", falling back to ", u.socketType)
+		}
+	}
+
+	if mode, exists := configMap["mode"]; exists {
+		parsed, err := strconv.ParseUint(mode.(string), 8, 32)
+		if err != nil {
+			u.log.Error("Invalid socket mode ", mode, ", expected an octal number like 0660")
+		} else {
+			u.mode = os.FileMode(parsed)
+		}
+	}
+
+	if owner, exists := configMap["owner"]; exists {
+		u.owner = owner.(string)
+	}
+
+	if group, exists := configMap["group"]; exists {
+		u.group = group.(string)
+	}
+
+	u.framing = u.configureFraming(configMap)
+	u.configureCommonParams(configMap)
+}
+
+// Listen passes incoming traffic to the channel to be picked up
+// by forwarder
+func (u *Unix) Listen() {
+	if err := removeStaleSocket(u.path); err != nil {
+		u.log.Fatal("Cannot listen on socket ", err)
+	}
+
+	if u.socketType == unixDatagram {
+		u.listenDatagram()
+	} else {
+		u.listenStream()
+	}
+}
+
+func (u *Unix) listenStream() {
+	addr := &net.UnixAddr{Name: u.path, Net: "unix"}
+	l, err := net.ListenUnix("unix", addr)
+	if err != nil {
+		u.log.Fatal("Cannot listen on socket ", err)
+	}
+	defer l.Close()
+
+	if err := u.setPermissions(); err != nil {
+		u.log.Fatal("Cannot set socket permissions ", err)
+	}
+
+	for {
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			u.log.Fatal(err)
+		}
+
+		go u.readMessage(conn)
+	}
+}
+
+// readMessage reads from the connection
+func (u *Unix) readMessage(conn *net.UnixConn) {
+	defer conn.Close()
+	conn.SetReadBuffer(u.ReadBuffer())
+
+	u.log.Debug("Connection started on ", u.path)
+	u.readFrames(conn, u.framing)
+	u.log.Debug("Connection closed on ", u.path)
+}
+
+func (u *Unix) listenDatagram() {
+	addr := &net.UnixAddr{Name: u.path, Net: "unixgram"}
+	conn, err := net.ListenUnixgram("unixgram", addr)
+	if err != nil {
+		u.log.Fatal("Cannot listen on socket ", err)
+	}
+	defer conn.Close()
+
+	if err := u.setPermissions(); err != nil {
+		u.log.Fatal("Cannot set socket permissions ", err)
+	}
+
+	conn.SetReadBuffer(u.ReadBuffer())
+	line := make([]byte, u.MaxMsgSize())
+
+	for {
+		n, peer, err := conn.ReadFromUnix(line)
+		if err != nil {
+			u.countError(err)
+			u.log.Warn("Error while reading message: ", err)
+			break
+		}
+
+		u.log.Debug("Read: ", string(line[0:n]))
+		u.Channel() <- u.stamp(message.Copy(line[0:n]), unixPeer(peer), message.FramingDatagram)
+	}
+}
+
+// unixPeer returns peer as a net.Addr, unbound senders have no address
+func unixPeer(peer *net.UnixAddr) net.Addr {
+	if peer == nil || peer.Name == "" {
+		return nil
+	}
+	return peer
+}
+
+// setPermissions applies the configured mode and ownership to the socket file
+func (u *Unix) setPermissions() error {
+	if u.mode != 0 {
+		if err := os.Chmod(u.path, u.mode); err != nil {
+			return err
+		}
+	}
+
+	if u.owner == "" && u.group == "" {
+		return nil
+	}
+
+	uid, gid := -1, -1
+	if u.owner != "" {
+		usr, err := user.Lookup(u.owner)
+		if err != nil {
+			usr, err = user.LookupId(u.owner)
+		}
+		if err != nil {
+			return fmt.Errorf("unknown owner %s", u.owner)
+		}
+		uid, _ = strconv.Atoi(usr.Uid)
+	}
+
+	if u.group != "" {
+		grp, err := user.LookupGroup(u.group)
+		if err != nil {
+			grp, err = user.LookupGroupId(u.group)
+		}
+		if err != nil {
+			return fmt.Errorf("unknown group %s", u.group)
+		}
+		gid, _ = strconv.Atoi(grp.Gid)
+	}
+
+	return os.Chown(u.path, uid, gid)
+}
+
+// removeStaleSocket removes a socket file left behind by a previous run.
+// A socket somebody still listens on and files that aren't sockets are left alone.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	for _, network := range []string{"unix", "unixgram"} {
+		if conn, err := net.Dial(network, path); err == nil {
+			conn.Close()
+			return fmt.Errorf("%s is in use by another process", path)
+		}
+	}
+
+	return os.Remove(path)
+}
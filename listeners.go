@@ -4,6 +4,8 @@ import (
 	"github.com/tsheasha/relayd/config"
 	"github.com/tsheasha/relayd/forwarder"
 	"github.com/tsheasha/relayd/listener"
+	"github.com/tsheasha/relayd/message"
+	"github.com/tsheasha/relayd/ratelimit"
 )
 
 func startListeners(c config.Config) (listeners []listener.Listener) {
@@ -35,17 +37,116 @@ func startListener(name string, globalConfig config.Config, instanceConfig map[s
 }
 
 func readFromListeners(listeners []listener.Listener, forwarders []forwarder.Forwarder) {
+	connectDiverts(listeners, forwarders)
+
 	for i := range listeners {
 		go readFromListener(listeners[i], forwarders)
 	}
 }
 
 func readFromListener(l listener.Listener, forwarders []forwarder.Forwarder) {
+	var channels []chan *message.Message
+	for i := range forwarders {
+		if c, exists := forwarders[i].ListenerChannels()[l.Name()]; exists {
+			channels = append(channels, c)
+		}
+	}
+
+	limiter := l.RateLimiter()
+	if limiter != nil && limiter.Action() == ratelimit.Delay {
+		// the listener delays messages as it reads them, see stamp
+		limiter = nil
+	}
+
 	for msg := range l.Channel() {
-		for i := range forwarders {
-			if _, exists := forwarders[i].ListenerChannels()[l.Name()]; exists {
-				forwarders[i].ListenerChannels()[l.Name()] <- msg
+		if limiter != nil && !limiter.Take(msg, len(msg.Payload)) {
+			if limiter.Action() != ratelimit.Divert || !limiter.Divert(msg) {
+				msg.Fail()
+				msg.Release()
+			}
+		} else {
+			// every forwarder releases its reference once done with the message,
+			// they're all taken before the first one could release its own
+			msg.Retain(len(channels))
+			for _, c := range channels {
+				c <- msg
+			}
+			if len(channels) == 0 {
+				// nothing relays it, it mustn't be taken as done
+				msg.Fail()
+			}
+			msg.Release()
+		}
+	}
+}
+
+// connectDiverts hands the rate limiters diverting messages the channels
+// of the forwarder they divert to, before any message is read. Forwarders
+// diverting to one another in a loop would pass the messages over both
+// their limits back and forth, they drop them instead.
+func connectDiverts(listeners []listener.Listener, forwarders []forwarder.Forwarder) {
+	var limiters []*ratelimit.Limiter
+	for _, l := range listeners {
+		limiters = append(limiters, l.RateLimiter())
+	}
+
+	loops := divertLoops(forwarders)
+	for _, f := range forwarders {
+		if f == nil {
+			continue
+		}
+		if loops[f.Name()] {
+			log.Error("Diverting from ", f.Name(), " to ", f.RateLimiter().DivertTo(), " loops back to ", f.Name(), ", dropping instead")
+			continue
+		}
+		limiters = append(limiters, f.RateLimiter())
+	}
+
+	for _, limiter := range limiters {
+		if limiter == nil || limiter.Action() != ratelimit.Divert {
+			continue
+		}
+
+		found := false
+		for _, f := range forwarders {
+			if f != nil && f.Name() == limiter.DivertTo() {
+				limiter.SetDivert(f.ListenerChannels())
+				found = true
+			}
+		}
+		if !found {
+			log.Error("Cannot divert to ", limiter.DivertTo(), ", there's no such forwarder, dropping instead")
+		}
+	}
+}
+
+// divertLoops returns the names of the forwarders whose diverted
+// messages would eventually be diverted back to them
+func divertLoops(forwarders []forwarder.Forwarder) map[string]bool {
+	divertTo := make(map[string]string)
+	for _, f := range forwarders {
+		if f == nil {
+			continue
+		}
+		if limiter := f.RateLimiter(); limiter != nil && limiter.Action() == ratelimit.Divert {
+			divertTo[f.Name()] = limiter.DivertTo()
+		}
+	}
+
+	loops := make(map[string]bool)
+	for name := range divertTo {
+		seen := map[string]bool{name: true}
+		for next, exists := divertTo[name]; exists; next, exists = divertTo[next] {
+			if next == name {
+				loops[name] = true
+				break
+			}
+			if seen[next] {
+				// a loop further down, not through name
+				break
 			}
+			seen[next] = true
 		}
 	}
+	return loops
 }
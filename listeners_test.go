@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/tsheasha/relayd/forwarder"
+	"github.com/tsheasha/relayd/ratelimit"
+)
+
+// divertingForwarder only has a name and a rate limiter
+type divertingForwarder struct {
+	forwarder.Forwarder
+	name    string
+	limiter *ratelimit.Limiter
+}
+
+func (f *divertingForwarder) Name() string {
+	return f.name
+}
+
+func (f *divertingForwarder) RateLimiter() *ratelimit.Limiter {
+	return f.limiter
+}
+
+// newDivertingForwarders creates forwarders diverting to the
+// forwarder named by divertTo, or limiting without diverting
+func newDivertingForwarders(t *testing.T, divertTo map[string]string) []forwarder.Forwarder {
+	var forwarders []forwarder.Forwarder
+	for name, to := range divertTo {
+		c := ratelimit.Config{MsgsPerSec: 1}
+		if to != "" {
+			c.Action = ratelimit.Divert
+			c.DivertTo = to
+		}
+		limiter, err := ratelimit.New(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		forwarders = append(forwarders, &divertingForwarder{name: name, limiter: limiter})
+	}
+	// forwarders that failed to be created are left nil
+	return append(forwarders, nil)
+}
+
+func TestDivertLoops(t *testing.T) {
+	tests := []struct {
+		name     string
+		divertTo map[string]string
+		loops    map[string]bool
+	}{
+		{"chain", map[string]string{"A": "B", "B": "C", "C": ""}, map[string]bool{}},
+		{"missing forwarder", map[string]string{"A": "Z"}, map[string]bool{}},
+		{"two", map[string]string{"A": "B", "B": "A"}, map[string]bool{"A": true, "B": true}},
+		{"three", map[string]string{"A": "B", "B": "C", "C": "A"}, map[string]bool{"A": true, "B": true, "C": true}},
+		{"into a loop", map[string]string{"A": "B", "B": "C", "C": "B"}, map[string]bool{"B": true, "C": true}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			loops := divertLoops(newDivertingForwarders(t, test.divertTo))
+			if !reflect.DeepEqual(loops, test.loops) {
+				t.Errorf("expected loops %v, got %v", test.loops, loops)
+			}
+		})
+	}
+}
@@ -84,7 +84,7 @@ func start(ctx *cli.Context) {
 	listeners := startListeners(c)
 	forwarders := startForwarders(c)
 
-	internalServer := internalserver.New(c, &forwarders)
+	internalServer := internalserver.New(c, &listeners, &forwarders)
 	go internalServer.Run()
 
 	readFromListeners(listeners, forwarders)
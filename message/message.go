@@ -0,0 +1,137 @@
+// Package message defines what listeners hand over to the forwarders.
+package message
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Framings a message can be received with, see Message.Framing
+const (
+	FramingDatagram = "datagram" // a whole datagram
+	FramingRaw      = "raw"      // unframed, what a read returned or a whole body
+	FramingNewline  = "newline"  // a line, without the newline
+	FramingLength   = "length"   // a length prefixed frame
+	FramingRFC6587  = "rfc6587"  // syslog octet counting or newline
+	FramingJSON     = "json"     // an element of a JSON array
+	FramingRecord   = "record"   // a record of a message queue, e.g. Kafka
+)
+
+// Message is a relayed payload along with the attributes the listener
+// extracted from it, e.g. the syslog facility, which forwarders route on,
+// and where and when it was received.
+//
+// A message is shared by every forwarder it's fanned out to and counts its
+// references: whoever passes it on retains it for every receiver, and every
+// receiver releases it once done with the payload. Messages created with
+// Copy go back to a pool when the last reference is released. A receiver
+// that couldn't pass the message on reports it with Fail before releasing
+// it, for the listener to learn with OnDone.
+type Message struct {
+	Payload    []byte
+	Attributes map[string]string
+
+	// Received is when the listener read the message
+	Received time.Time
+
+	// Source is the name of the listener the message came from
+	Source string
+
+	// Peer is the remote address the message came from, nil if unknown
+	Peer net.Addr
+
+	// Framing is how the message was delimited, one of the Framing constants
+	Framing string
+
+	refs int32
+
+	// called by the last release, see OnDone
+	done   func(m *Message, ok bool)
+	failed int32
+
+	// the pooled buffer Payload points into, nil if not pooled
+	buf   []byte
+	class int
+}
+
+// New creates a message without attributes, the payload is not copied
+// and must not be modified by the caller afterwards
+func New(payload []byte) *Message {
+	return &Message{Payload: payload, refs: 1}
+}
+
+// Attribute returns the value of an attribute and whether it is set
+func (m *Message) Attribute(name string) (string, bool) {
+	value, exists := m.Attributes[name]
+	return value, exists
+}
+
+// Field returns an attribute or, if there's none by that name, the
+// metadata field source, framing or peer, the peer without its port
+func (m *Message) Field(name string) (string, bool) {
+	if value, exists := m.Attributes[name]; exists {
+		return value, true
+	}
+
+	switch name {
+	case "source":
+		return m.Source, m.Source != ""
+	case "framing":
+		return m.Framing, m.Framing != ""
+	case "peer":
+		if m.Peer == nil {
+			return "", false
+		}
+		peer := m.Peer.String()
+		if host, _, err := net.SplitHostPort(peer); err == nil {
+			return host, true
+		}
+		return peer, true
+	}
+	return "", false
+}
+
+// SetAttribute sets an attribute, allocating the map on first use
+func (m *Message) SetAttribute(name, value string) {
+	if m.Attributes == nil {
+		m.Attributes = make(map[string]string)
+	}
+	m.Attributes[name] = value
+}
+
+// OnDone sets f to be called by the last release of the message, with ok
+// false if a receiver called Fail. It's set before the message is passed on.
+func (m *Message) OnDone(f func(m *Message, ok bool)) {
+	m.done = f
+}
+
+// Fail reports that the message couldn't be passed on, e.g. it was dropped
+// or its write failed, it's called before releasing the message
+func (m *Message) Fail() {
+	atomic.StoreInt32(&m.failed, 1)
+}
+
+// Retain adds n references to the message
+func (m *Message) Retain(n int) {
+	atomic.AddInt32(&m.refs, int32(n))
+}
+
+// Release drops a reference, neither the message nor its payload may be
+// used by the caller afterwards. The last release calls the OnDone function
+// and returns a pooled message to its pool.
+func (m *Message) Release() {
+	refs := atomic.AddInt32(&m.refs, -1)
+	if refs < 0 {
+		panic("message: released more often than retained")
+	}
+	if refs > 0 {
+		return
+	}
+	if m.done != nil {
+		m.done(m, atomic.LoadInt32(&m.failed) == 0)
+	}
+	if m.buf != nil {
+		put(m)
+	}
+}
@@ -0,0 +1,70 @@
+package message
+
+import (
+	"math/bits"
+	"sync"
+	"time"
+)
+
+// Pooled buffers come in power of two size classes from 256 bytes to
+// 64 KiB, larger payloads are allocated and left to the garbage collector
+const (
+	minClassBits = 8
+	maxClassBits = 16
+)
+
+var pools [maxClassBits - minClassBits + 1]sync.Pool
+
+// Copy returns a message holding a copy of b in a pooled buffer, for
+// listeners reading into a buffer they reuse. The message goes back to
+// the pool once it has been released by every holder.
+func Copy(b []byte) *Message {
+	m := get(len(b))
+	copy(m.Payload, b)
+	return m
+}
+
+// get returns a message with a payload of n bytes and a single reference
+func get(n int) *Message {
+	class := sizeClass(n)
+	if class < 0 {
+		return &Message{Payload: make([]byte, n), refs: 1}
+	}
+
+	if v := pools[class].Get(); v != nil {
+		m := v.(*Message)
+		m.Payload = m.buf[:n]
+		m.refs = 1
+		return m
+	}
+
+	buf := make([]byte, 1<<uint(class+minClassBits))
+	return &Message{Payload: buf[:n], refs: 1, buf: buf, class: class}
+}
+
+// put returns m to its pool, keeping the attributes map for reuse
+func put(m *Message) {
+	m.Payload = nil
+	m.Received = time.Time{}
+	m.Source = ""
+	m.Peer = nil
+	m.Framing = ""
+	m.done = nil
+	m.failed = 0
+	for name := range m.Attributes {
+		delete(m.Attributes, name)
+	}
+	pools[m.class].Put(m)
+}
+
+// sizeClass returns the pool holding buffers of at least n bytes,
+// -1 if n is too large to be pooled
+func sizeClass(n int) int {
+	if n > 1<<maxClassBits {
+		return -1
+	}
+	if n <= 1<<minClassBits {
+		return 0
+	}
+	return bits.Len(uint(n-1)) - minClassBits
+}
@@ -0,0 +1,68 @@
+// Package rate measures message and byte throughput per second
+// over sliding windows.
+package rate
+
+import (
+	"sync"
+	"time"
+)
+
+// Windows are the windows rates are averaged over, by the suffix
+// they're reported with. None may be longer than a minute.
+var Windows = map[string]int{
+	"10s": 10,
+	"1m":  60,
+}
+
+// one slot per second of the longest window, plus the current second
+const slots = 61
+
+// Meter counts messages and their bytes per second, safe for concurrent use
+type Meter struct {
+	lock    sync.Mutex
+	seconds [slots]int64
+	msgs    [slots]uint64
+	bytes   [slots]uint64
+}
+
+// Mark records a message of n bytes
+func (m *Meter) Mark(n int) {
+	now := time.Now().Unix()
+	i := now % slots
+
+	m.lock.Lock()
+	if m.seconds[i] != now {
+		// the slot last held a second that's out of every window
+		m.seconds[i] = now
+		m.msgs[i] = 0
+		m.bytes[i] = 0
+	}
+	m.msgs[i]++
+	m.bytes[i] += uint64(n)
+	m.lock.Unlock()
+}
+
+// Rates returns the messages and bytes per second over each window,
+// the current second isn't over yet so it's left out
+func (m *Meter) Rates() (msgs map[string]float64, bytes map[string]float64) {
+	now := time.Now().Unix()
+	msgs = make(map[string]float64, len(Windows))
+	bytes = make(map[string]float64, len(Windows))
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for name, window := range Windows {
+		var msgsSum, bytesSum uint64
+		for second := now - int64(window); second < now; second++ {
+			i := second % slots
+			if m.seconds[i] == second {
+				msgsSum += m.msgs[i]
+				bytesSum += m.bytes[i]
+			}
+		}
+		msgs[name] = float64(msgsSum) / float64(window)
+		bytes[name] = float64(bytesSum) / float64(window)
+	}
+	return msgs, bytes
+}
@@ -0,0 +1,328 @@
+// Package ratelimit limits messages per second and bytes per second with
+// token buckets, for a whole listener or forwarder or per remote address.
+package ratelimit
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tsheasha/relayd/config"
+	"github.com/tsheasha/relayd/message"
+)
+
+// Actions on the messages over the limit
+const (
+	// Drop drops them
+	Drop = "drop"
+
+	// Delay holds them until they're within the limit, which
+	// slows the sender down as far as the protocol allows
+	Delay = "delay"
+
+	// Divert sends them through another forwarder instead
+	Divert = "divert"
+)
+
+// maxPeers is how many remote addresses are tracked before the
+// least recently seen ones are forgotten
+const maxPeers = 10000
+
+// Config of a Limiter, a rate of 0 isn't limited
+type Config struct {
+	MsgsPerSec  float64
+	BytesPerSec float64
+
+	// PerPeer limits every remote address on its own
+	PerPeer bool
+
+	Action   string
+	DivertTo string
+}
+
+// Parse creates the Limiter configured by the rate limit option of a
+// listener (rateLimit) or forwarder (rate_limit), e.g.
+//
+//	{"msgs_per_sec": 1000, "bytes_per_sec": 1048576,
+//		"per_peer": true, "action": "divert", "divert_to": "Kafka"}
+//
+// Unknown keys are an error rather than left unlimited.
+func Parse(value interface{}) (*Limiter, error) {
+	asMap, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("ratelimit: expected a map")
+	}
+
+	var c Config
+	for key, v := range asMap {
+		switch key {
+		case "msgs_per_sec":
+			c.MsgsPerSec = config.GetAsFloat(v, 0)
+		case "bytes_per_sec":
+			c.BytesPerSec = config.GetAsFloat(v, 0)
+		case "per_peer":
+			c.PerPeer = config.GetAsBool(v, false)
+		case "action":
+			c.Action = fmt.Sprint(v)
+		case "divert_to":
+			c.DivertTo = fmt.Sprint(v)
+		default:
+			return nil, errors.New("ratelimit: unknown key " + key)
+		}
+	}
+	return New(c)
+}
+
+// Limiter applies a Config to messages, safe for concurrent use
+type Limiter struct {
+	config Config
+
+	lock   sync.Mutex
+	shared *buckets
+	peers  map[string]*list.Element
+	// the buckets of the peers, most recently seen first
+	recent *list.List
+
+	// where diverted messages go, by the listener they came from
+	divert map[string]chan *message.Message
+
+	msgsDropped  uint64
+	msgsDelayed  uint64
+	msgsDiverted uint64
+}
+
+// New validates config and creates a Limiter applying it
+func New(config Config) (*Limiter, error) {
+	if config.MsgsPerSec < 0 || config.BytesPerSec < 0 {
+		return nil, errors.New("ratelimit: rates can't be negative")
+	}
+	if config.MsgsPerSec == 0 && config.BytesPerSec == 0 {
+		return nil, errors.New("ratelimit: no rate set")
+	}
+
+	switch config.Action {
+	case "":
+		config.Action = Drop
+	case Drop, Delay:
+	case Divert:
+		if config.DivertTo == "" {
+			return nil, errors.New("ratelimit: divert needs a forwarder to divert to")
+		}
+	default:
+		return nil, errors.New("ratelimit: unknown action " + config.Action)
+	}
+
+	l := &Limiter{config: config}
+	if config.PerPeer {
+		l.peers = make(map[string]*list.Element)
+		l.recent = list.New()
+	} else {
+		l.shared = newBuckets(config)
+	}
+	return l, nil
+}
+
+// Action taken on the messages over the limit
+func (l *Limiter) Action() string {
+	return l.config.Action
+}
+
+// DivertTo is the forwarder diverted messages go to
+func (l *Limiter) DivertTo() string {
+	return l.config.DivertTo
+}
+
+// SetDivert sets the channels of the forwarder to divert to,
+// by listener name, before any message is taken
+func (l *Limiter) SetDivert(channels map[string]chan *message.Message) {
+	l.divert = channels
+}
+
+// Take takes msg, of size bytes, out of the limit. It returns false if
+// msg is over it, in which case the caller applies the action. With Delay
+// msg is always taken, after waiting for as long as it's over the limit.
+func (l *Limiter) Take(msg *message.Message, size int) bool {
+	b := l.shared
+	if b == nil {
+		peer, _ := msg.Field("peer")
+		b = l.peerBuckets(peer)
+	}
+
+	if l.config.Action != Delay {
+		if b.take(float64(size)) {
+			return true
+		}
+		if l.config.Action == Drop {
+			atomic.AddUint64(&l.msgsDropped, 1)
+		}
+		return false
+	}
+
+	if wait := b.reserve(float64(size)); wait > 0 {
+		atomic.AddUint64(&l.msgsDelayed, 1)
+		time.Sleep(wait)
+	}
+	return true
+}
+
+// Divert passes msg, and the reference to it, to the forwarder diverted
+// to. It returns false if that forwarder doesn't read from msg's source
+// or is too busy to take it right away, the message is left to the caller
+// then. Never waiting keeps forwarders diverting to one another from
+// blocking each other.
+func (l *Limiter) Divert(msg *message.Message) bool {
+	channel, exists := l.divert[msg.Source]
+	if !exists {
+		atomic.AddUint64(&l.msgsDropped, 1)
+		return false
+	}
+
+	select {
+	case channel <- msg:
+		atomic.AddUint64(&l.msgsDiverted, 1)
+		return true
+	default:
+		atomic.AddUint64(&l.msgsDropped, 1)
+		return false
+	}
+}
+
+// AddMetrics adds the counters of the limiter, and with PerPeer the
+// number of remote addresses tracked, to the maps passed
+func (l *Limiter) AddMetrics(counters, gauges map[string]float64) {
+	counters["rateLimitDropped"] = float64(atomic.LoadUint64(&l.msgsDropped))
+	counters["rateLimitDelayed"] = float64(atomic.LoadUint64(&l.msgsDelayed))
+	counters["rateLimitDiverted"] = float64(atomic.LoadUint64(&l.msgsDiverted))
+
+	if l.config.PerPeer {
+		l.lock.Lock()
+		gauges["rateLimitPeers"] = float64(len(l.peers))
+		l.lock.Unlock()
+	}
+}
+
+// peerEntry is an element of Limiter.recent
+type peerEntry struct {
+	peer    string
+	buckets *buckets
+}
+
+func (l *Limiter) peerBuckets(peer string) *buckets {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if e, exists := l.peers[peer]; exists {
+		l.recent.MoveToFront(e)
+		return e.Value.(*peerEntry).buckets
+	}
+
+	if len(l.peers) >= maxPeers {
+		oldest := l.recent.Back()
+		l.recent.Remove(oldest)
+		delete(l.peers, oldest.Value.(*peerEntry).peer)
+	}
+
+	b := newBuckets(l.config)
+	l.peers[peer] = l.recent.PushFront(&peerEntry{peer: peer, buckets: b})
+	return b
+}
+
+// buckets limit messages and bytes together
+type buckets struct {
+	lock  sync.Mutex
+	msgs  *bucket
+	bytes *bucket
+}
+
+func newBuckets(config Config) *buckets {
+	now := time.Now()
+	b := new(buckets)
+	if config.MsgsPerSec > 0 {
+		b.msgs = newBucket(config.MsgsPerSec, now)
+	}
+	if config.BytesPerSec > 0 {
+		b.bytes = newBucket(config.BytesPerSec, now)
+	}
+	return b
+}
+
+// take takes a message of size bytes if both buckets allow it
+func (b *buckets) take(size float64) bool {
+	now := time.Now()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if !b.msgs.allows(1, now) || !b.bytes.allows(size, now) {
+		return false
+	}
+	b.msgs.remove(1)
+	b.bytes.remove(size)
+	return true
+}
+
+// reserve takes a message of size bytes whatever the buckets hold
+// and returns how long to wait until it's within the limit
+func (b *buckets) reserve(size float64) time.Duration {
+	now := time.Now()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.msgs.allows(1, now)
+	b.bytes.allows(size, now)
+	b.msgs.remove(1)
+	b.bytes.remove(size)
+
+	wait := b.msgs.debt()
+	if bytesWait := b.bytes.debt(); bytesWait > wait {
+		wait = bytesWait
+	}
+	return wait
+}
+
+// bucket is a token bucket holding up to a second's worth of tokens,
+// a nil bucket doesn't limit anything. Its tokens go negative when
+// reserved ahead of time.
+type bucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate float64, now time.Time) *bucket {
+	return &bucket{rate: rate, tokens: rate, last: now}
+}
+
+func (b *bucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+}
+
+// allows refills the bucket and tells whether n tokens can be taken,
+// more than a full bucket holds can be taken from a full bucket
+func (b *bucket) allows(n float64, now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	b.refill(now)
+	return b.tokens >= n || b.tokens >= b.rate
+}
+
+func (b *bucket) remove(n float64) {
+	if b != nil {
+		b.tokens -= n
+	}
+}
+
+// debt is how long the bucket takes to get back to 0 tokens
+func (b *bucket) debt() time.Duration {
+	if b == nil || b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
@@ -0,0 +1,199 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tsheasha/relayd/message"
+)
+
+// newTestLimiter parses a JSON rate limit option
+func newTestLimiter(t *testing.T, option string) *Limiter {
+	var value interface{}
+	if err := json.Unmarshal([]byte(option), &value); err != nil {
+		t.Fatal(err)
+	}
+	limiter, err := Parse(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return limiter
+}
+
+func peerMsg(peer string) *message.Message {
+	msg := message.New(nil)
+	msg.SetAttribute("peer", peer)
+	return msg
+}
+
+func TestParse(t *testing.T) {
+	l := newTestLimiter(t, `{"msgs_per_sec": "5", "bytes_per_sec": 100,
+		"per_peer": true, "action": "divert", "divert_to": "Kafka"}`)
+
+	expected := Config{MsgsPerSec: 5, BytesPerSec: 100, PerPeer: true, Action: Divert, DivertTo: "Kafka"}
+	if l.config != expected {
+		t.Errorf("expected %+v, got %+v", expected, l.config)
+	}
+	if l.Action() != Divert || l.DivertTo() != "Kafka" {
+		t.Errorf("unexpected action %s to %s", l.Action(), l.DivertTo())
+	}
+
+	if l := newTestLimiter(t, `{"msgs_per_sec": 5}`); l.Action() != Drop {
+		t.Errorf("expected drop by default, got %s", l.Action())
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		option interface{}
+		err    string
+	}{
+		{"not a map", "1000", "expected a map"},
+		{"camel case", map[string]interface{}{"msgsPerSec": 1000.0}, "unknown key msgsPerSec"},
+		{"no rate", map[string]interface{}{"action": "drop"}, "no rate set"},
+		{"negative", map[string]interface{}{"msgs_per_sec": -1.0}, "can't be negative"},
+		{"unknown action", map[string]interface{}{"msgs_per_sec": 1.0, "action": "queue"}, "unknown action"},
+		{"divert nowhere", map[string]interface{}{"msgs_per_sec": 1.0, "action": "divert"}, "divert needs"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limiter, err := Parse(test.option)
+			if limiter != nil || err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("expected an error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestTakeDrops(t *testing.T) {
+	tests := []struct {
+		name   string
+		option string
+		sizes  []int
+		taken  []bool
+	}{
+		{"msgs", `{"msgs_per_sec": 2}`, []int{1, 1, 1}, []bool{true, true, false}},
+		{"bytes", `{"bytes_per_sec": 10}`, []int{6, 4, 1}, []bool{true, true, false}},
+		{"both", `{"msgs_per_sec": 5, "bytes_per_sec": 10}`, []int{8, 4}, []bool{true, false}},
+		// a full bucket lets a message larger than it through
+		{"larger than a second's worth", `{"bytes_per_sec": 10}`, []int{50, 1}, []bool{true, false}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l := newTestLimiter(t, test.option)
+			for i, size := range test.sizes {
+				if taken := l.Take(message.New(nil), size); taken != test.taken[i] {
+					t.Errorf("message %d of %d bytes: expected taken %v", i, size, test.taken[i])
+				}
+			}
+
+			dropped := 0
+			for _, taken := range test.taken {
+				if !taken {
+					dropped++
+				}
+			}
+			counters := make(map[string]float64)
+			l.AddMetrics(counters, make(map[string]float64))
+			if counters["rateLimitDropped"] != float64(dropped) {
+				t.Errorf("expected %d dropped, got %v", dropped, counters["rateLimitDropped"])
+			}
+		})
+	}
+}
+
+func TestTakeDelays(t *testing.T) {
+	l := newTestLimiter(t, `{"msgs_per_sec": 20, "action": "delay"}`)
+
+	start := time.Now()
+	for i := 0; i < 22; i++ {
+		if !l.Take(message.New(nil), 1) {
+			t.Fatal("expected delay to take every message")
+		}
+	}
+
+	// 20 right away, 2 more at 20 per second
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("expected the messages over the limit to wait, took %s", elapsed)
+	}
+	counters := make(map[string]float64)
+	l.AddMetrics(counters, make(map[string]float64))
+	if counters["rateLimitDelayed"] != 2 {
+		t.Errorf("expected 2 delayed, got %v", counters["rateLimitDelayed"])
+	}
+}
+
+func TestTakePerPeer(t *testing.T) {
+	l := newTestLimiter(t, `{"msgs_per_sec": 1, "per_peer": true}`)
+
+	if !l.Take(peerMsg("10.0.0.1"), 1) || !l.Take(peerMsg("10.0.0.2"), 1) {
+		t.Fatal("expected every peer to have its own bucket")
+	}
+	if l.Take(peerMsg("10.0.0.1"), 1) {
+		t.Error("expected a peer over its limit to be dropped")
+	}
+
+	gauges := make(map[string]float64)
+	l.AddMetrics(make(map[string]float64), gauges)
+	if gauges["rateLimitPeers"] != 2 {
+		t.Errorf("expected 2 peers tracked, got %v", gauges["rateLimitPeers"])
+	}
+}
+
+func TestPeersEvictedLeastRecentlySeenFirst(t *testing.T) {
+	l := newTestLimiter(t, `{"msgs_per_sec": 1, "per_peer": true}`)
+
+	for i := 0; i < maxPeers; i++ {
+		l.Take(peerMsg(fmt.Sprint("peer", i)), 1)
+	}
+	// peer0 is seen again, peer1 becomes the least recently seen
+	l.Take(peerMsg("peer0"), 1)
+	l.Take(peerMsg("new"), 1)
+
+	if len(l.peers) != maxPeers {
+		t.Fatalf("expected %d peers tracked, got %d", maxPeers, len(l.peers))
+	}
+	if _, exists := l.peers["peer1"]; exists {
+		t.Error("expected the least recently seen peer to be forgotten")
+	}
+	if _, exists := l.peers["peer0"]; !exists {
+		t.Error("expected a peer seen again to be kept")
+	}
+
+	// a forgotten peer starts over with a full bucket
+	if !l.Take(peerMsg("peer1"), 1) {
+		t.Error("expected a forgotten peer to be taken again")
+	}
+}
+
+func TestDivert(t *testing.T) {
+	l := newTestLimiter(t, `{"msgs_per_sec": 1, "action": "divert", "divert_to": "Kafka"}`)
+	channel := make(chan *message.Message, 1)
+	l.SetDivert(map[string]chan *message.Message{"UDP": channel})
+
+	msg := message.New(nil)
+	msg.Source = "UDP"
+	if !l.Divert(msg) || len(channel) != 1 {
+		t.Fatal("expected the message to be diverted")
+	}
+	if l.Divert(msg) {
+		t.Error("expected a full channel not to take the message")
+	}
+
+	msg.Source = "TCP"
+	if l.Divert(msg) {
+		t.Error("expected a source the forwarder doesn't read from not to be diverted")
+	}
+
+	counters := make(map[string]float64)
+	l.AddMetrics(counters, make(map[string]float64))
+	if counters["rateLimitDiverted"] != 1 || counters["rateLimitDropped"] != 2 {
+		t.Errorf("expected 1 diverted and 2 dropped, got %v", counters)
+	}
+}
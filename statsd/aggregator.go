@@ -0,0 +1,135 @@
+package statsd
+
+import (
+	"strconv"
+	"sync"
+)
+
+// maxSamplesPerLine bounds the length of the lines timers
+// and sets are flushed as
+const maxSamplesPerLine = 100
+
+// Aggregator pre-aggregates metrics between flushes: counters are summed,
+// gauges keep their last value, timers, histograms, distributions and sets
+// are packed into multi-value lines. Metrics are keyed by name, type and tags.
+type Aggregator struct {
+	mu      sync.Mutex
+	metrics map[string]*aggregate
+}
+
+type aggregate struct {
+	name string
+	typ  string
+	tags string
+
+	// counters, and gauges set relatively or absolutely
+	sum      float64
+	absolute bool
+
+	// timers, histograms, distributions and sets
+	samples []Sample
+	seen    map[string]bool
+}
+
+// NewAggregator returns an empty Aggregator
+func NewAggregator() *Aggregator {
+	return &Aggregator{metrics: make(map[string]*aggregate)}
+}
+
+// Add aggregates m into the current interval
+func (a *Aggregator) Add(m *Metric) {
+	key := m.Name + "|" + m.Type + "|#" + m.Tags
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	agg, exists := a.metrics[key]
+	if !exists {
+		agg = &aggregate{name: m.Name, typ: m.Type, tags: m.Tags}
+		a.metrics[key] = agg
+	}
+
+	for _, sample := range m.Samples {
+		switch m.Type {
+		case Counter:
+			value, _ := strconv.ParseFloat(sample.Value, 64)
+			agg.sum += value / sample.Rate
+		case Gauge:
+			value, _ := strconv.ParseFloat(sample.Value, 64)
+			if sample.Value[0] == '+' || sample.Value[0] == '-' {
+				agg.sum += value
+			} else {
+				agg.sum = value
+				agg.absolute = true
+			}
+		case Set:
+			if agg.seen == nil {
+				agg.seen = make(map[string]bool)
+			}
+			if !agg.seen[sample.Value] {
+				agg.seen[sample.Value] = true
+				agg.samples = append(agg.samples, Sample{Value: sample.Value, Rate: 1})
+			}
+		default:
+			agg.samples = append(agg.samples, sample)
+		}
+	}
+}
+
+// Len returns the number of metrics aggregated in the current interval
+func (a *Aggregator) Len() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.metrics)
+}
+
+// Flush returns the metrics aggregated since the last flush and resets them
+func (a *Aggregator) Flush() []*Metric {
+	a.mu.Lock()
+	metrics := a.metrics
+	a.metrics = make(map[string]*aggregate)
+	a.mu.Unlock()
+
+	flushed := make([]*Metric, 0, len(metrics))
+	for _, agg := range metrics {
+		flushed = append(flushed, agg.flush()...)
+	}
+	return flushed
+}
+
+func (agg *aggregate) flush() []*Metric {
+	newMetric := func(samples ...Sample) *Metric {
+		return &Metric{Name: agg.name, Type: agg.typ, Tags: agg.tags, Samples: samples}
+	}
+
+	switch agg.typ {
+	case Counter:
+		return []*Metric{newMetric(Sample{Value: formatFloat(agg.sum), Rate: 1})}
+	case Gauge:
+		value := formatFloat(agg.sum)
+		switch {
+		case !agg.absolute && agg.sum == 0:
+			return nil
+		case !agg.absolute && agg.sum > 0:
+			return []*Metric{newMetric(Sample{Value: "+" + value, Rate: 1})}
+		case agg.absolute && agg.sum < 0:
+			// a negative value would be taken as a decrement, reset to 0 first
+			return []*Metric{newMetric(Sample{Value: "0", Rate: 1}, Sample{Value: value, Rate: 1})}
+		}
+		return []*Metric{newMetric(Sample{Value: value, Rate: 1})}
+	}
+
+	var flushed []*Metric
+	for start := 0; start < len(agg.samples); start += maxSamplesPerLine {
+		end := start + maxSamplesPerLine
+		if end > len(agg.samples) {
+			end = len(agg.samples)
+		}
+		flushed = append(flushed, newMetric(agg.samples[start:end]...))
+	}
+	return flushed
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
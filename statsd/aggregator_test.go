@@ -0,0 +1,92 @@
+package statsd
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+// aggregateLines adds the lines to a new aggregator and returns
+// the sorted lines it flushes
+func aggregateLines(t *testing.T, lines ...string) []string {
+	a := NewAggregator()
+	for _, line := range lines {
+		metrics, err := Parse([]byte(line))
+		if err != nil {
+			t.Fatalf("%q: %s", line, err)
+		}
+		for _, m := range metrics {
+			a.Add(m)
+		}
+	}
+
+	var flushed []string
+	for _, m := range a.Flush() {
+		flushed = append(flushed, string(m.Append(nil)))
+	}
+	sort.Strings(flushed)
+
+	if a.Len() != 0 || len(a.Flush()) != 0 {
+		t.Error("expected the aggregator to be reset by a flush")
+	}
+	return flushed
+}
+
+func TestAggregator(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []string
+		out  []string
+	}{
+		{"counters", []string{"a:1|c", "a:2|c", "b:1|c"}, []string{"a:3|c", "b:1|c"}},
+		{"sample rate", []string{"a:1|c|@0.5", "a:2|c|@0.1", "a:1|c"}, []string{"a:23|c"}},
+		{"multi-value counter", []string{"a:1|c:2|c|@0.5"}, []string{"a:5|c"}},
+		{"tags", []string{"a:1|c|#env:prod", "a:1|c|#env:dev", "a:1|c|#env:prod"}, []string{"a:1|c|#env:dev", "a:2|c|#env:prod"}},
+		{"gauge last value", []string{"g:5|g", "g:7|g"}, []string{"g:7|g"}},
+		{"gauge relative after absolute", []string{"g:5|g", "g:+3|g", "g:-1|g"}, []string{"g:7|g"}},
+		{"gauge absolute after relative", []string{"g:+3|g", "g:5|g"}, []string{"g:5|g"}},
+		{"gauge increment", []string{"g:+3|g", "g:+2|g"}, []string{"g:+5|g"}},
+		{"gauge decrement", []string{"g:+3|g", "g:-5|g"}, []string{"g:-2|g"}},
+		{"gauge unchanged", []string{"g:+3|g", "g:-3|g"}, nil},
+		{"gauge absolute negative", []string{"g:1|g", "g:-3|g"}, []string{"g:0|g:-2|g"}},
+		{"set dedupe", []string{"u:a|s", "u:b|s", "u:a|s:c|s"}, []string{"u:a|s:b|s:c|s"}},
+		{"timers packed", []string{"t:1|ms", "t:2|ms|@0.5"}, []string{"t:1|ms:2|ms|@0.5"}},
+		{"types apart", []string{"a:1|c", "a:1|g"}, []string{"a:1|c", "a:1|g"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out := aggregateLines(t, test.in...)
+			if strings.Join(out, "\n") != strings.Join(test.out, "\n") {
+				t.Errorf("expected %q, got %q", test.out, out)
+			}
+		})
+	}
+}
+
+func TestAggregatorGaugeResetRoundTrip(t *testing.T) {
+	// the reset and the negative value have to set the gauge, not decrement it
+	out := aggregateLines(t, "g:1|g", "g:-3|g")
+	if len(out) != 1 {
+		t.Fatalf("expected one line, got %q", out)
+	}
+	if again := aggregateLines(t, out[0]); len(again) != 1 || again[0] != out[0] {
+		t.Errorf("expected %q to aggregate to itself, got %q", out[0], again)
+	}
+}
+
+func TestAggregatorSplitsLongLines(t *testing.T) {
+	lines := make([]string, maxSamplesPerLine+1)
+	for i := range lines {
+		lines[i] = "t:1|h"
+	}
+
+	out := aggregateLines(t, lines...)
+	if len(out) != 2 {
+		t.Fatalf("expected 2 lines, got %d", len(out))
+	}
+	// sorted, the shorter line comes first
+	if n := strings.Count(out[1], "|h"); n != maxSamplesPerLine {
+		t.Errorf("expected %d samples in the longest line, got %d", maxSamplesPerLine, n)
+	}
+}
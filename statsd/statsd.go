@@ -0,0 +1,138 @@
+// Package statsd parses and aggregates StatsD metric lines.
+package statsd
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Metric types
+const (
+	Counter      = "c"
+	Gauge        = "g"
+	Timer        = "ms"
+	Histogram    = "h"
+	Distribution = "d"
+	Set          = "s"
+)
+
+// Metric is a parsed StatsD line:
+//
+//	name:value|type[|@rate][:value|type[|@rate]...][|#tags]
+//
+// Lines holding values of different types are split into one Metric per type.
+type Metric struct {
+	Name string
+	Type string
+
+	// Tags are the DogStatsD tags, without the leading "|#"
+	Tags string
+
+	Samples []Sample
+}
+
+// Sample is a single value of a metric
+type Sample struct {
+	// Value as sent, gauges keep their +/- sign, sets any string
+	Value string
+
+	// Rate is the sample rate, 1 when the value wasn't sampled
+	Rate float64
+}
+
+// Parse parses a single line, multi-metric packets have
+// to be split on newlines first
+func Parse(line []byte) ([]*Metric, error) {
+	line = bytes.TrimRight(line, "\r")
+
+	// tags may contain ':' so they're cut off before splitting the values
+	var tags string
+	if i := bytes.Index(line, []byte("|#")); i >= 0 {
+		tags = string(line[i+2:])
+		line = line[:i]
+	}
+
+	bits := strings.Split(string(line), ":")
+	if len(bits) < 2 {
+		return nil, errors.New("statsd: missing value")
+	}
+
+	name := bits[0]
+	if name == "" || strings.ContainsAny(name, "| \t") {
+		return nil, errors.New("statsd: invalid metric name")
+	}
+
+	var metrics []*Metric
+	for _, bit := range bits[1:] {
+		typ, sample, err := parseSample(bit)
+		if err != nil {
+			return nil, err
+		}
+
+		last := len(metrics) - 1
+		if last < 0 || metrics[last].Type != typ {
+			metrics = append(metrics, &Metric{Name: name, Type: typ, Tags: tags})
+			last++
+		}
+		metrics[last].Samples = append(metrics[last].Samples, sample)
+	}
+	return metrics, nil
+}
+
+// parseSample parses "value|type[|@rate]"
+func parseSample(bit string) (string, Sample, error) {
+	fields := strings.Split(bit, "|")
+	if len(fields) < 2 || len(fields) > 3 {
+		return "", Sample{}, errors.New("statsd: expected value|type[|@rate]")
+	}
+
+	sample := Sample{Value: fields[0], Rate: 1}
+	typ := fields[1]
+	switch typ {
+	case Counter, Gauge, Timer, Histogram, Distribution:
+		if _, err := strconv.ParseFloat(sample.Value, 64); err != nil {
+			return "", Sample{}, errors.New("statsd: invalid value " + sample.Value)
+		}
+	case Set:
+		if sample.Value == "" {
+			return "", Sample{}, errors.New("statsd: empty set value")
+		}
+	default:
+		return "", Sample{}, errors.New("statsd: unknown type " + typ)
+	}
+
+	if len(fields) == 3 {
+		if !strings.HasPrefix(fields[2], "@") {
+			return "", Sample{}, errors.New("statsd: invalid sample rate " + fields[2])
+		}
+		rate, err := strconv.ParseFloat(fields[2][1:], 64)
+		if err != nil || rate <= 0 || rate > 1 {
+			return "", Sample{}, errors.New("statsd: invalid sample rate " + fields[2])
+		}
+		sample.Rate = rate
+	}
+	return typ, sample, nil
+}
+
+// Append appends the metric as a StatsD line to dst
+func (m *Metric) Append(dst []byte) []byte {
+	dst = append(dst, m.Name...)
+	for _, sample := range m.Samples {
+		dst = append(dst, ':')
+		dst = append(dst, sample.Value...)
+		dst = append(dst, '|')
+		dst = append(dst, m.Type...)
+		if sample.Rate != 1 {
+			dst = append(dst, "|@"...)
+			dst = strconv.AppendFloat(dst, sample.Rate, 'g', -1, 64)
+		}
+	}
+
+	if m.Tags != "" {
+		dst = append(dst, "|#"...)
+		dst = append(dst, m.Tags...)
+	}
+	return dst
+}
@@ -0,0 +1,88 @@
+package statsd
+
+import (
+	"strings"
+	"testing"
+)
+
+// appendAll appends the metrics as lines, one per metric, joined with newlines
+func appendAll(metrics []*Metric) string {
+	lines := make([]string, len(metrics))
+	for i, m := range metrics {
+		lines[i] = string(m.Append(nil))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestParseAppend(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{"a.b:1|c", "a.b:1|c"},
+		{"a:1.5|c|@0.5", "a:1.5|c|@0.5"},
+		{"a:1|c\r", "a:1|c"},
+		{"a:-5|g", "a:-5|g"},
+		{"a:+3|g", "a:+3|g"},
+		{"a:42|g", "a:42|g"},
+		{"a:320|ms|@0.1", "a:320|ms|@0.1"},
+		{"a:1|h", "a:1|h"},
+		{"a:1|d", "a:1|d"},
+		{"a:user-1|s", "a:user-1|s"},
+		{"a:1|ms:2|ms|@0.5:3|ms", "a:1|ms:2|ms|@0.5:3|ms"},
+		{"a:1|ms:2|ms:3|c", "a:1|ms:2|ms\na:3|c"},
+		{"a:1|c|#env:prod,role:web", "a:1|c|#env:prod,role:web"},
+		{"a:1|ms:2|c|#env:prod", "a:1|ms|#env:prod\na:2|c|#env:prod"},
+	}
+
+	for _, test := range tests {
+		metrics, err := Parse([]byte(test.in))
+		if err != nil {
+			t.Errorf("%q: %s", test.in, err)
+			continue
+		}
+		if out := appendAll(metrics); out != test.out {
+			t.Errorf("%q: expected %q, got %q", test.in, test.out, out)
+		}
+	}
+}
+
+func TestParseSamples(t *testing.T) {
+	metrics, err := Parse([]byte("a:1|ms|@0.25:x|s|#t"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metrics) != 2 {
+		t.Fatalf("expected 2 metrics, got %d", len(metrics))
+	}
+	if m := metrics[0]; m.Name != "a" || m.Type != Timer || m.Tags != "t" || m.Samples[0] != (Sample{"1", 0.25}) {
+		t.Errorf("unexpected timer %+v", m)
+	}
+	if m := metrics[1]; m.Type != Set || m.Samples[0] != (Sample{"x", 1}) {
+		t.Errorf("unexpected set %+v", m)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, in := range []string{
+		"",
+		"a",
+		":1|c",
+		"a b:1|c",
+		"a|b:1|c",
+		"a:1",
+		"a:x|c",
+		"a:1|x",
+		"a:|s",
+		"a:1|c|0.5",
+		"a:1|c|@0",
+		"a:1|c|@1.5",
+		"a:1|c|@x",
+		"a:1|c|@0.5|x",
+		"a:1|c:",
+	} {
+		if metrics, err := Parse([]byte(in)); err == nil {
+			t.Errorf("%q: expected an error, got %q", in, appendAll(metrics))
+		}
+	}
+}
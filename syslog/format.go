@@ -0,0 +1,75 @@
+package syslog
+
+import (
+	"strconv"
+	"time"
+)
+
+// Header holds the RFC 5424 header fields of an outgoing message
+type Header struct {
+	Facility int
+	Severity int
+	Hostname string
+	AppName  string
+	ProcID   string
+	MsgID    string
+}
+
+// FacilityCode returns the code of a facility keyword, e.g. local0
+func FacilityCode(name string) (int, bool) {
+	return indexOf(Facilities, name)
+}
+
+// SeverityCode returns the code of a severity keyword, e.g. err
+func SeverityCode(name string) (int, bool) {
+	return indexOf(Severities, name)
+}
+
+// AppendRFC5424 appends msg with an RFC 5424 header stamped ts to dst,
+// without structured data:
+//
+//	<PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID - MSG
+func AppendRFC5424(dst []byte, h *Header, ts time.Time, msg []byte) []byte {
+	dst = append(dst, '<')
+	dst = strconv.AppendInt(dst, int64(h.Facility*8+h.Severity), 10)
+	dst = append(dst, ">1 "...)
+	dst = ts.UTC().AppendFormat(dst, "2006-01-02T15:04:05.000000Z07:00")
+	dst = append(dst, ' ')
+	dst = appendField(dst, h.Hostname, 255)
+	dst = append(dst, ' ')
+	dst = appendField(dst, h.AppName, 48)
+	dst = append(dst, ' ')
+	dst = appendField(dst, h.ProcID, 128)
+	dst = append(dst, ' ')
+	dst = appendField(dst, h.MsgID, 32)
+	dst = append(dst, " - "...)
+	return append(dst, msg...)
+}
+
+// appendField appends a header field, "-" if empty, as printable
+// US-ASCII truncated to the maximum length allowed by the RFC
+func appendField(dst []byte, field string, maxLen int) []byte {
+	if field == "" {
+		return append(dst, '-')
+	}
+	if len(field) > maxLen {
+		field = field[:maxLen]
+	}
+	for i := 0; i < len(field); i++ {
+		if c := field[i]; c > 32 && c < 127 {
+			dst = append(dst, c)
+		} else {
+			dst = append(dst, '_')
+		}
+	}
+	return dst
+}
+
+func indexOf(names []string, name string) (int, bool) {
+	for i, n := range names {
+		if n == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
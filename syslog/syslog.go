@@ -0,0 +1,242 @@
+// Package syslog parses RFC 3164 and RFC 5424 syslog messages.
+package syslog
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// Formats of a parsed message
+const (
+	RFC3164 = "rfc3164"
+	RFC5424 = "rfc5424"
+)
+
+// Facilities indexed by their code
+var Facilities = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+// Severities indexed by their code
+var Severities = []string{
+	"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug",
+}
+
+// ErrInvalidPriority is returned for messages not starting with <PRI>
+var ErrInvalidPriority = errors.New("syslog: invalid priority")
+
+// Message is a parsed syslog message, missing fields are left empty
+type Message struct {
+	Format         string
+	Facility       int
+	Severity       int
+	Timestamp      string
+	Hostname       string
+	AppName        string
+	ProcID         string
+	MsgID          string
+	StructuredData string
+
+	// Msg is the free form part, it shares the parsed buffer
+	Msg []byte
+}
+
+// FacilityName returns the keyword of the facility
+func (m *Message) FacilityName() string {
+	return Facilities[m.Facility]
+}
+
+// SeverityName returns the keyword of the severity
+func (m *Message) SeverityName() string {
+	return Severities[m.Severity]
+}
+
+// Parse parses an RFC 5424 message, or falls back to RFC 3164 if the
+// priority isn't followed by the version and a timestamp. RFC 3164 is
+// parsed leniently, most senders only roughly follow it.
+func Parse(b []byte) (*Message, error) {
+	b = bytes.TrimRight(b, "\r\n\x00")
+
+	pri, rest, err := parsePriority(b)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Message{Facility: pri / 8, Severity: pri % 8}
+	if is5424(rest) {
+		m.Format = RFC5424
+		return m, parse5424(m, rest[2:])
+	}
+
+	m.Format = RFC3164
+	parse3164(m, rest)
+	return m, nil
+}
+
+// parsePriority parses <PRI>, 0 to 191
+func parsePriority(b []byte) (int, []byte, error) {
+	if len(b) < 3 || b[0] != '<' {
+		return 0, nil, ErrInvalidPriority
+	}
+
+	end := bytes.IndexByte(b[:min(len(b), 5)], '>')
+	if end < 2 {
+		return 0, nil, ErrInvalidPriority
+	}
+
+	pri, err := strconv.Atoi(string(b[1:end]))
+	if err != nil || pri < 0 || pri > 191 {
+		return 0, nil, ErrInvalidPriority
+	}
+	return pri, b[end+1:], nil
+}
+
+// is5424 tells whether what follows <PRI> starts like an RFC 5424 header,
+// with the version and a timestamp, RFC 3164 content can start with "1 "
+func is5424(b []byte) bool {
+	if !bytes.HasPrefix(b, []byte("1 ")) {
+		return false
+	}
+
+	timestamp, _, ok := nextField(b[2:])
+	if !ok {
+		return false
+	}
+	if timestamp == "-" {
+		return true
+	}
+	_, err := time.Parse(time.RFC3339Nano, timestamp)
+	return err == nil
+}
+
+// parse5424 parses what follows "<PRI>1 ":
+//
+//	TIMESTAMP SP HOSTNAME SP APP-NAME SP PROCID SP MSGID SP STRUCTURED-DATA [SP MSG]
+func parse5424(m *Message, b []byte) error {
+	headers := []*string{&m.Timestamp, &m.Hostname, &m.AppName, &m.ProcID, &m.MsgID}
+	for _, header := range headers {
+		field, rest, ok := nextField(b)
+		if !ok {
+			return errors.New("syslog: truncated RFC 5424 header")
+		}
+		*header = nilValue(field)
+		b = rest
+	}
+
+	sd, rest, err := structuredData(b)
+	if err != nil {
+		return err
+	}
+	m.StructuredData = nilValue(sd)
+
+	if len(rest) > 0 && rest[0] == ' ' {
+		rest = rest[1:]
+	}
+	m.Msg = bytes.TrimPrefix(rest, []byte("\xef\xbb\xbf"))
+	return nil
+}
+
+// structuredData returns the STRUCTURED-DATA field, either "-"
+// or a sequence of [elements] in which "]" can be escaped
+func structuredData(b []byte) (string, []byte, error) {
+	if len(b) > 0 && b[0] == '-' {
+		return "-", b[1:], nil
+	}
+
+	i := 0
+	for i < len(b) && b[i] == '[' {
+		inQuotes := false
+		for i++; i < len(b); i++ {
+			if b[i] == '\\' && inQuotes {
+				i++
+			} else if b[i] == '"' {
+				inQuotes = !inQuotes
+			} else if b[i] == ']' && !inQuotes {
+				break
+			}
+		}
+		if i >= len(b) {
+			return "", nil, errors.New("syslog: unterminated structured data")
+		}
+		i++
+	}
+
+	if i == 0 {
+		return "", nil, errors.New("syslog: missing structured data")
+	}
+	return string(b[:i]), b[i:], nil
+}
+
+// parse3164 parses what follows "<PRI>": [TIMESTAMP SP HOSTNAME SP] TAG[PID]: MSG
+func parse3164(m *Message, b []byte) {
+	if len(b) >= len(time.Stamp) {
+		if _, err := time.Parse(time.Stamp, string(b[:len(time.Stamp)])); err == nil {
+			m.Timestamp = string(b[:len(time.Stamp)])
+			b = bytes.TrimLeft(b[len(time.Stamp):], " ")
+
+			// the hostname is often left out, a tag ends with ":" or "[pid]:"
+			if field, rest, ok := nextField(b); ok && !isTag(field) {
+				m.Hostname = field
+				b = rest
+			}
+		}
+	}
+
+	// TAG is alphanumeric and at most 32 characters
+	end := 0
+	for end < len(b) && end < 32 && isTagChar(b[end]) {
+		end++
+	}
+	if end == 0 || end == len(b) || (b[end] != ':' && b[end] != '[') {
+		m.Msg = b
+		return
+	}
+	m.AppName = string(b[:end])
+	b = b[end:]
+
+	if b[0] == '[' {
+		if closing := bytes.IndexByte(b, ']'); closing > 0 {
+			m.ProcID = string(b[1:closing])
+			b = b[closing+1:]
+		}
+	}
+
+	b = bytes.TrimPrefix(b, []byte(":"))
+	m.Msg = bytes.TrimPrefix(b, []byte(" "))
+}
+
+// nextField returns the field up to the next space
+func nextField(b []byte) (string, []byte, bool) {
+	end := bytes.IndexByte(b, ' ')
+	if end <= 0 {
+		return "", nil, false
+	}
+	return string(b[:end]), b[end+1:], true
+}
+
+func isTag(field string) bool {
+	return field[len(field)-1] == ':' || bytes.IndexByte([]byte(field), '[') > 0
+}
+
+func isTagChar(c byte) bool {
+	return c != ':' && c != '[' && c != ' ' && c > 32 && c < 127
+}
+
+// nilValue maps the RFC 5424 NILVALUE "-" to ""
+func nilValue(field string) string {
+	if field == "-" {
+		return ""
+	}
+	return field
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,105 @@
+package syslog
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want Message
+	}{
+		{
+			"rfc5424",
+			"<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog 1234 ID47 [exampleSDID@32473 iut=\"3\"] An application event\n",
+			Message{Format: RFC5424, Facility: 20, Severity: 5, Timestamp: "2003-10-11T22:14:15.003Z",
+				Hostname: "mymachine.example.com", AppName: "evntslog", ProcID: "1234", MsgID: "ID47",
+				StructuredData: "[exampleSDID@32473 iut=\"3\"]", Msg: []byte("An application event")},
+		},
+		{
+			"rfc5424 nil values and BOM",
+			"<13>1 - - - - - - \xef\xbb\xbfhello",
+			Message{Format: RFC5424, Facility: 1, Severity: 5, Msg: []byte("hello")},
+		},
+		{
+			"rfc5424 escaped structured data without msg",
+			`<34>1 2003-10-11T22:14:15Z host app - - [a x="q\"]"][b y="2"]`,
+			Message{Format: RFC5424, Facility: 4, Severity: 2, Timestamp: "2003-10-11T22:14:15Z",
+				Hostname: "host", AppName: "app", StructuredData: `[a x="q\"]"][b y="2"]`, Msg: []byte{}},
+		},
+		{
+			"rfc3164",
+			"<34>Oct 11 22:14:15 mymachine su[42]: 'su root' failed for lonvick",
+			Message{Format: RFC3164, Facility: 4, Severity: 2, Timestamp: "Oct 11 22:14:15",
+				Hostname: "mymachine", AppName: "su", ProcID: "42", Msg: []byte("'su root' failed for lonvick")},
+		},
+		{
+			"rfc3164 without hostname",
+			"<13>Feb  5 17:32:18 sshd: accepted",
+			Message{Format: RFC3164, Facility: 1, Severity: 5, Timestamp: "Feb  5 17:32:18",
+				AppName: "sshd", Msg: []byte("accepted")},
+		},
+		{
+			"rfc3164 without header",
+			"<13>just a message",
+			Message{Format: RFC3164, Facility: 1, Severity: 5, Msg: []byte("just a message")},
+		},
+		{
+			"rfc3164 content starting with 1",
+			"<13>1 apple fell",
+			Message{Format: RFC3164, Facility: 1, Severity: 5, Msg: []byte("1 apple fell")},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := Parse([]byte(test.in))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got.Msg) != string(test.want.Msg) {
+				t.Errorf("expected msg %q, got %q", test.want.Msg, got.Msg)
+			}
+			got.Msg, test.want.Msg = nil, nil
+			if !reflect.DeepEqual(*got, test.want) {
+				t.Errorf("expected %+v, got %+v", test.want, *got)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, in := range []string{
+		"",
+		"no priority",
+		"<>1 - - - - - -",
+		"<192>too high",
+		"<-1>negative",
+		"<1234>too long",
+		"<13>1 2003-10-11T22:14:15Z host",
+		"<13>1 2003-10-11T22:14:15Z host app proc msgid [unterminated",
+		"<13>1 2003-10-11T22:14:15Z host app proc msgid nosd",
+	} {
+		if m, err := Parse([]byte(in)); err == nil {
+			t.Errorf("%q: expected an error, got %+v", in, m)
+		}
+	}
+}
+
+func TestAppendRFC5424RoundTrip(t *testing.T) {
+	h := &Header{Facility: 16, Severity: 3, Hostname: "web 1", AppName: "relayd", MsgID: "m"}
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 6000, time.UTC)
+
+	m, err := Parse(AppendRFC5424(nil, h, ts, []byte("payload")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Format != RFC5424 || m.FacilityName() != "local0" || m.SeverityName() != "err" ||
+		m.Timestamp != "2020-01-02T03:04:05.000006Z" || m.Hostname != "web_1" ||
+		m.AppName != "relayd" || m.ProcID != "" || m.MsgID != "m" || string(m.Msg) != "payload" {
+		t.Errorf("unexpected round trip %+v", m)
+	}
+}
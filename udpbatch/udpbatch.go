@@ -0,0 +1,27 @@
+// Package udpbatch reads and writes batches of UDP datagrams with a single
+// recvmmsg/sendmmsg system call on the platforms supporting it.
+package udpbatch
+
+import (
+	"golang.org/x/net/ipv4"
+)
+
+// Message is a datagram of a batch, N is the number of bytes read into
+// or written from Buffers
+type Message = ipv4.Message
+
+// Conn reads and writes batches of datagrams, the ipv4 and ipv6
+// PacketConns of golang.org/x/net both implement it
+type Conn interface {
+	ReadBatch(ms []Message, flags int) (int, error)
+	WriteBatch(ms []Message, flags int) (int, error)
+}
+
+// NewMessages returns n messages with a buffer of size bytes each, to read into
+func NewMessages(n, size int) []Message {
+	ms := make([]Message, n)
+	for i := range ms {
+		ms[i].Buffers = [][]byte{make([]byte, size)}
+	}
+	return ms
+}
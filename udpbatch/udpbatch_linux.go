@@ -0,0 +1,17 @@
+package udpbatch
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// New returns a batch Conn on top of conn, using recvmmsg and sendmmsg
+func New(conn *net.UDPConn) Conn {
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() != nil {
+		return ipv4.NewPacketConn(conn)
+	}
+	// also covers dual stack sockets, IPv4 peers show up as v4-mapped addresses
+	return ipv6.NewPacketConn(conn)
+}
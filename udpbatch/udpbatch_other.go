@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package udpbatch
+
+import (
+	"net"
+)
+
+// New returns nil, batches are only supported on Linux, callers
+// fall back to reading and writing a datagram at a time
+func New(conn *net.UDPConn) Conn {
+	return nil
+}